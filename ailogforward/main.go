@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common"
+
+	// Handlers register themselves when imported
+	_ "github.com/jjjordanmsft/ApplicationInsights-logforward/handlers/nginx"
+	_ "github.com/jjjordanmsft/ApplicationInsights-logforward/handlers/otlp"
+	_ "github.com/jjjordanmsft/ApplicationInsights-logforward/handlers/trace"
+)
+
+func main() {
+	common.RunMultiple("ailogforward", common.Handlers())
+}
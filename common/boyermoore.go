@@ -0,0 +1,113 @@
+package common
+
+// boyerMoore holds the tables for a Boyer-Moore search.  The parser used to
+// find separators this way; it's kept for ParserOptions.legacy, so that
+// benchmarks can compare it with strings.Index.
+type boyerMoore struct {
+	badChars     [256]int
+	goodSuffixes []int
+}
+
+func compileBoyerMoore(pattern string) *boyerMoore {
+	result := &boyerMoore{}
+	length := len(pattern)
+	last := length - 1
+
+	// Bad character rule
+	for i := 0; i < 256; i++ {
+		result.badChars[i] = length
+	}
+	for i := 0; i < length; i++ {
+		result.badChars[pattern[i]] = last - i
+	}
+
+	// Good suffix rule - http://www-igm.univ-mlv.fr/~lecroq/string/node14.html
+
+	// For each position i, pattern[:i+1] has the same suffix as pattern for suffixes[i] bytes,
+	// or: pattern[i-suffixes[i]+1:i+1] == pattern[len(pattern)-suffixes[i]:]
+	suffixes := make([]int, length)
+
+	g := last
+	f := last - 1
+	suffixes[last] = length
+
+	for i := last - 1; i >= 0; i-- {
+		if i > g && suffixes[i+last-f] < i-g {
+			suffixes[i] = suffixes[i+last-f]
+		} else {
+			if i < g {
+				g = i
+			}
+			f = i
+			for g >= 0 && pattern[g] == pattern[g+last-f] {
+				g--
+			}
+			suffixes[i] = f - g
+		}
+	}
+
+	// Build jump table based on matching suffixes, above.
+
+	result.goodSuffixes = make([]int, length)
+	for i := 0; i < length; i++ {
+		result.goodSuffixes[i] = length
+	}
+
+	j := 0
+	for i := last; i >= 0; i-- {
+		if suffixes[i] == i+1 {
+			for ; j < last-i; j++ {
+				if result.goodSuffixes[j] == length {
+					result.goodSuffixes[j] = last - i
+				}
+			}
+		}
+	}
+
+	for i := 0; i < last; i++ {
+		result.goodSuffixes[last-suffixes[i]] = last - i
+	}
+
+	return result
+}
+
+// search is like stringSearcher.Search.
+func (bm *boyerMoore) search(pattern, line string, start int, escapes [][]int) (int, int, int, error) {
+	escidx := 0
+
+	for i := start; i <= len(line)-len(pattern); {
+		j := len(pattern) - 1
+
+		// Skip over escapes we've already passed
+		for escidx < len(escapes) && escapes[escidx][1] <= i {
+			escidx++
+		}
+
+		// Skip i over the next escape if we're in the middle of it
+		if escidx < len(escapes) && escapes[escidx][0] <= (j+i) {
+			i = escapes[escidx][1]
+			continue
+		}
+
+		// Perform check
+		for j >= 0 && pattern[j] == line[i+j] {
+			j--
+		}
+		if j < 0 {
+			// Matched
+			return i, i + len(pattern), escidx, nil
+		}
+
+		// No match
+		bc := bm.badChars[line[i+j]] - len(pattern) + 1 + j
+		gs := bm.goodSuffixes[j]
+
+		if bc > gs {
+			i += bc
+		} else {
+			i += gs
+		}
+	}
+
+	return 0, 0, 0, NO_MATCH
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// telemetryClient submits telemetry to an appinsights.TelemetryChannel.  The
+// SDK's own client doesn't let us touch the envelope before it is sent, which
+// we need in order to report the sample rate, so we build envelopes here.
+type telemetryClient struct {
+	context  *appinsights.TelemetryContext
+	channel  appinsights.TelemetryChannel
+	nameIKey string
+}
+
+func newTelemetryClient(config *appinsights.TelemetryConfiguration, channel appinsights.TelemetryChannel) *telemetryClient {
+	context := appinsights.NewTelemetryContext(config.InstrumentationKey)
+	context.Tags.Internal().SetSdkVersion("go:" + appinsights.Version)
+	context.Tags.Device().SetOsVersion(runtime.GOOS)
+
+	if hostname, err := os.Hostname(); err == nil {
+		context.Tags.Device().SetId(hostname)
+		context.Tags.Cloud().SetRoleInstance(hostname)
+	}
+
+	return &telemetryClient{
+		context:  context,
+		channel:  channel,
+		nameIKey: strings.Replace(config.InstrumentationKey, "-", "", -1),
+	}
+}
+
+func (tc *telemetryClient) Context() *appinsights.TelemetryContext {
+	return tc.context
+}
+
+func (tc *telemetryClient) Channel() appinsights.TelemetryChannel {
+	return tc.channel
+}
+
+// Track submits the telemetry item, marking it as representing 100/sampleRate
+// original items.
+func (tc *telemetryClient) Track(item appinsights.Telemetry, sampleRate float64) {
+	if item != nil {
+		tc.channel.Send(tc.envelop(item, sampleRate))
+	}
+}
+
+// Mirrors appinsights.TelemetryContext.envelop
+func (tc *telemetryClient) envelop(item appinsights.Telemetry, sampleRate float64) *contracts.Envelope {
+	// Apply common properties
+	if props := item.GetProperties(); props != nil {
+		for k, v := range tc.context.CommonProperties {
+			if _, ok := props[k]; !ok {
+				props[k] = v
+			}
+		}
+	}
+
+	tdata := item.TelemetryData()
+	data := contracts.NewData()
+	data.BaseType = tdata.BaseType()
+	data.BaseData = tdata
+
+	envelope := contracts.NewEnvelope()
+	envelope.Name = tdata.EnvelopeName(tc.nameIKey)
+	envelope.Data = data
+	envelope.IKey = tc.context.InstrumentationKey()
+	envelope.SampleRate = sampleRate
+
+	timestamp := item.Time()
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	envelope.Time = timestamp.UTC().Format("2006-01-02T15:04:05.999999Z")
+
+	if contextTags := item.ContextTags(); contextTags != nil {
+		envelope.Tags = contextTags
+	} else {
+		envelope.Tags = make(map[string]string)
+	}
+
+	// Copy in default tag values.
+	for k, v := range tc.context.Tags {
+		if _, ok := envelope.Tags[k]; !ok {
+			envelope.Tags[k] = v
+		}
+	}
+
+	ensureOperationId(envelope.Tags)
+
+	// Sanitize.
+	for _, warn := range tdata.Sanitize() {
+		log.Printf("Telemetry data warning: %s", warn)
+	}
+	for _, warn := range contracts.SanitizeTags(envelope.Tags) {
+		log.Printf("Telemetry tag warning: %s", warn)
+	}
+
+	return envelope
+}
+
+// ensureOperationId assigns a new operation ID to the tags if they don't
+// already have one, and returns the operation ID.
+func ensureOperationId(tags contracts.ContextTags) string {
+	if id, ok := tags[contracts.OperationId]; ok {
+		return id
+	}
+
+	id := NewId()
+	tags[contracts.OperationId] = id
+	return id
+}
+
+// idSource generates IDs for NewId.  -deterministic replaces it with
+// sequentialIds.
+var idSource = randomId
+
+// NewId returns an ID for telemetry that the log doesn't provide one for,
+// like a request ID.  Handlers should use it rather than the SDK's random
+// IDs, so that -deterministic output can be compared between runs.
+func NewId() string {
+	return idSource()
+}
+
+func randomId() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// sequentialIds returns a generator of IDs that count up from 1, formatted
+// like UUIDs.
+func sequentialIds() func() string {
+	var next uint64
+	return func() string {
+		return fmt.Sprintf("00000000-0000-0000-0000-%012x", atomic.AddUint64(&next, 1))
+	}
+}
@@ -0,0 +1,309 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	pipelinesKey = "pipelines"
+	envPrefix    = "AILOG_"
+)
+
+// Standard Application Insights environment variables, used when the
+// AILOG_ equivalent isn't set.
+var envAliases = map[string][]string{
+	"connection-string": {"APPLICATIONINSIGHTS_CONNECTION_STRING"},
+	"ikey":              {"APPINSIGHTS_INSTRUMENTATIONKEY"},
+}
+
+// Matches ${VAR} and ${VAR:-default}.  $${ escapes a literal ${.
+var envVarRE = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// configFile holds the contents of a YAML configuration file.  Keys are the
+// names of command line options; the pipelines key holds a list of maps of
+// per-pipeline options.
+type configFile struct {
+	values    map[string]interface{}
+	pipelines []map[string]interface{}
+}
+
+func loadConfig(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err.Error())
+	}
+
+	result := &configFile{values: make(map[string]interface{})}
+	for k, v := range raw {
+		if k != pipelinesKey {
+			result.values[k] = normalizeConfig(v)
+			continue
+		}
+
+		lst, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Error parsing %s: %s must be a list", path, pipelinesKey)
+		}
+
+		for i, p := range lst {
+			pipeline, ok := normalizeConfig(p).(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Error parsing %s: pipeline %d is not a map", path, i+1)
+			}
+
+			result.pipelines = append(result.pipelines, pipeline)
+		}
+	}
+
+	return result, nil
+}
+
+// yaml.v2 produces map[interface{}]interface{} for nested maps; convert them
+// to string keys.
+func normalizeConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{})
+		for k, val := range v {
+			result[fmt.Sprint(k)] = normalizeConfig(val)
+		}
+		return result
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalizeConfig(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// applyConfig sets flags from configuration values, except for those in
+// skip.  Lists set the flag once per item, and maps set it once per entry
+// as 'key=value'.
+func applyConfig(flags *flag.FlagSet, values map[string]interface{}, skip map[string]bool) error {
+	// Apply in a consistent order
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if skip[k] {
+			continue
+		}
+
+		if flags.Lookup(k) == nil {
+			return fmt.Errorf("Unknown option in configuration: %s", k)
+		}
+
+		args, err := configArgs(k, values[k])
+		if err != nil {
+			return err
+		}
+
+		for _, arg := range args {
+			if err := flags.Set(k, arg); err != nil {
+				return fmt.Errorf("Invalid value for %s in configuration: %s", k, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func configArgs(key string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			if !isScalar(item) {
+				return nil, fmt.Errorf("Invalid value for %s in configuration: lists may only contain values", key)
+			}
+
+			result = append(result, expandEnv(fmt.Sprint(item)))
+		}
+		return result, nil
+	case map[string]interface{}:
+		var result []string
+		for k, item := range v {
+			if !isScalar(item) {
+				return nil, fmt.Errorf("Invalid value for %s in configuration: maps may only contain values", key)
+			}
+
+			result = append(result, fmt.Sprintf("%s=%s", k, expandEnv(fmt.Sprint(item))))
+		}
+		sort.Strings(result)
+		return result, nil
+	default:
+		return []string{expandEnv(fmt.Sprint(v))}, nil
+	}
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case []interface{}, map[string]interface{}, nil:
+		return false
+	default:
+		return true
+	}
+}
+
+// expandEnv replaces ${VAR} with the value of the environment variable VAR,
+// or ${VAR:-default} with default if VAR is unset or empty.  Unlike
+// os.ExpandEnv, bare $VAR is left alone since nginx formats are full of them.
+func expandEnv(value string) string {
+	return envVarRE.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+
+		parts := envVarRE.FindStringSubmatch(match)
+		if val := os.Getenv(parts[1]); val != "" {
+			return val
+		}
+
+		return parts[2]
+	})
+}
+
+// setFlags returns the names of flags that were set on the command line or
+// by applyConfig.
+func setFlags(flags *flag.FlagSet) map[string]bool {
+	result := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		result[f.Name] = true
+	})
+
+	return result
+}
+
+// commandLineArgs returns the values given for each flag in args, in order.
+// Flags that can be given several times have one value per time.
+func commandLineArgs(flags *flag.FlagSet, args []string) map[string][]string {
+	result := make(map[string][]string)
+	recorder := flag.NewFlagSet("args", flag.ContinueOnError)
+	recorder.SetOutput(ioutil.Discard)
+	flags.VisitAll(func(f *flag.Flag) {
+		isBool := false
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			isBool = b.IsBoolFlag()
+		}
+
+		recorder.Var(&argRecorder{f.Name, isBool, result}, f.Name, "")
+	})
+
+	// The arguments were already parsed successfully
+	recorder.Parse(args)
+	return result
+}
+
+// argRecorder is a flag.Value that collects the values it's set to.
+type argRecorder struct {
+	name   string
+	isBool bool
+	values map[string][]string
+}
+
+func (r *argRecorder) String() string   { return "" }
+func (r *argRecorder) IsBoolFlag() bool { return r.isBool }
+func (r *argRecorder) Set(v string) error {
+	r.values[r.name] = append(r.values[r.name], v)
+	return nil
+}
+
+// pipelineDefaults returns the options that pipelines in the configuration
+// file inherit: the top level of the file, overridden by the command line.
+func pipelineDefaults(file map[string]interface{}, cmdline map[string][]string) map[string]interface{} {
+	result := make(map[string]interface{})
+	for k, v := range file {
+		result[k] = v
+	}
+
+	for k, args := range cmdline {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			values[i] = escapeEnv(arg)
+		}
+
+		result[k] = values
+	}
+
+	return result
+}
+
+// escapeEnv keeps expandEnv from changing a value that came from the command
+// line or the environment.
+func escapeEnv(value string) string {
+	return strings.Replace(value, "${", "$${", -1)
+}
+
+// envName returns the environment variable that holds a default for the
+// named flag, e.g. AILOG_ROLEINSTANCE for -roleinstance.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Options that a connection string supplies, which aren't read from the
+// environment when there is one.  A leftover instrumentation key shouldn't
+// be sent to the connection string's endpoint.
+var connectionStringOptions = map[string]bool{
+	"ikey":     true,
+	"endpoint": true,
+}
+
+// applyEnvironment sets flags that haven't already been set on the command
+// line or in the configuration file from environment variables.
+func applyEnvironment(flags *flag.FlagSet) error {
+	set := setFlags(flags)
+
+	hasConnString := false
+	if f := flags.Lookup("connection-string"); f != nil && f.Value.String() != "" {
+		hasConnString = true
+	} else if _, value := envValue("connection-string"); value != "" {
+		hasConnString = true
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil || (hasConnString && connectionStringOptions[f.Name]) {
+			return
+		}
+
+		if name, value := envValue(f.Name); value != "" {
+			if e := flags.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("Invalid value for %s in environment: %s", name, e.Error())
+			}
+		}
+	})
+
+	return err
+}
+
+// envValue returns the environment variable that holds a value for the
+// named flag, and its value, or an empty value if none is set.
+func envValue(flagName string) (string, string) {
+	for _, name := range append([]string{envName(flagName)}, envAliases[flagName]...) {
+		if value := os.Getenv(name); value != "" {
+			return name, value
+		}
+	}
+
+	return "", ""
+}
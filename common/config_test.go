@@ -0,0 +1,419 @@
+package common
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testConfigHandler struct {
+	format   string
+	include  RegexpList
+	noReject bool
+}
+
+func (handler *testConfigHandler) Initialize(*log.Logger, Tracker) error { return nil }
+func (handler *testConfigHandler) Receive(string) error                  { return nil }
+
+func newTestConfigHandler(flags *flag.FlagSet) LogHandler {
+	handler := &testConfigHandler{}
+	flags.StringVar(&handler.format, "format", "", "")
+	flags.Var(&handler.include, "include", "")
+	flags.BoolVar(&handler.noReject, "noreject", false, "")
+	return handler
+}
+
+func writeTestConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write config: %s", err.Error())
+	}
+
+	return path
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("TEST_CONFIG_IKEY", "abc")
+	os.Unsetenv("TEST_CONFIG_UNSET")
+
+	cases := [][]string{
+		{"${TEST_CONFIG_IKEY}", "abc"},
+		{"key-${TEST_CONFIG_IKEY}-key", "key-abc-key"},
+		{"${TEST_CONFIG_UNSET}", ""},
+		{"${TEST_CONFIG_UNSET:-default}", "default"},
+		{"${TEST_CONFIG_IKEY:-default}", "abc"},
+		{"$${TEST_CONFIG_IKEY}", "${TEST_CONFIG_IKEY}"},
+		{"$remote_addr $TEST_CONFIG_IKEY", "$remote_addr $TEST_CONFIG_IKEY"},
+	}
+
+	for _, c := range cases {
+		if actual := expandEnv(c[0]); actual != c[1] {
+			t.Errorf("expandEnv(%q) = %q, expected %q", c[0], actual, c[1])
+		}
+	}
+}
+
+func TestConfigPipelines(t *testing.T) {
+	path := writeTestConfig(t, `
+format: $remote_addr $status
+noreject: true
+include: [zero]
+outkeep: 3
+custom:
+  env: test
+pipelines:
+  - name: first
+    in: /var/log/first.log
+    include: [one, two]
+  - in: /var/log/second.log
+    out: "-"
+    outkeep: 1
+    format: $status
+`)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %s", err.Error())
+	}
+
+	if len(config.pipelines) != 2 {
+		t.Fatalf("Expected 2 pipelines, got %d", len(config.pipelines))
+	}
+
+	first, err := newConfigPipeline(0, config.pipelines[0], config.values, newTestConfigHandler, nil)
+	if err != nil {
+		t.Fatalf("newConfigPipeline failed: %s", err.Error())
+	}
+
+	handler := first.handler.(*testConfigHandler)
+	if first.name != "first" || first.infile != "/var/log/first.log" || first.outfile != "" || first.output.Keep != 3 {
+		t.Errorf("Unexpected first pipeline: %+v", first)
+	}
+
+	if handler.format != "$remote_addr $status" || !handler.noReject || len(handler.include) != 2 {
+		t.Errorf("Unexpected first handler: %+v", handler)
+	}
+
+	second, err := newConfigPipeline(1, config.pipelines[1], config.values, newTestConfigHandler, nil)
+	if err != nil {
+		t.Fatalf("newConfigPipeline failed: %s", err.Error())
+	}
+
+	handler = second.handler.(*testConfigHandler)
+	if second.name != "2" || second.outfile != "-" || second.output.Keep != 1 || handler.format != "$status" || len(handler.include) != 1 {
+		t.Errorf("Unexpected second pipeline: %+v %+v", second, handler)
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	var ikey, role string
+	var custom customProperties
+	flags.StringVar(&ikey, "ikey", "", "")
+	flags.StringVar(&role, "role", "", "")
+	flags.Var(&custom, "custom", "")
+	flags.Parse([]string{"-role", "cmdline"})
+
+	values := map[string]interface{}{
+		"ikey":   "file",
+		"role":   "file",
+		"custom": map[string]interface{}{"a": "1", "b": 2},
+	}
+
+	if err := applyConfig(flags, values, setFlags(flags)); err != nil {
+		t.Fatalf("applyConfig failed: %s", err.Error())
+	}
+
+	if ikey != "file" || role != "cmdline" || custom["a"] != "1" || custom["b"] != "2" {
+		t.Errorf("Unexpected values: %s %s %v", ikey, role, custom)
+	}
+
+	if err := applyConfig(flags, map[string]interface{}{"bogus": "1"}, nil); err == nil {
+		t.Error("Unknown options should be rejected")
+	}
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	var ikey, role, connString string
+	var quiet bool
+	flags.StringVar(&ikey, "ikey", "", "")
+	flags.StringVar(&role, "role", "", "")
+	flags.StringVar(&connString, "connection-string", "", "")
+	flags.BoolVar(&quiet, "quiet", false, "")
+	flags.Parse([]string{"-ikey", "cmdline"})
+
+	os.Setenv("AILOG_IKEY", "env")
+	os.Setenv("AILOG_ROLE", "env")
+	os.Setenv("AILOG_QUIET", "true")
+	os.Setenv("APPLICATIONINSIGHTS_CONNECTION_STRING", "InstrumentationKey=env")
+	defer func() {
+		for _, name := range []string{"AILOG_IKEY", "AILOG_ROLE", "AILOG_QUIET", "APPLICATIONINSIGHTS_CONNECTION_STRING"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	if err := applyEnvironment(flags); err != nil {
+		t.Fatalf("applyEnvironment failed: %s", err.Error())
+	}
+
+	if ikey != "cmdline" || role != "env" || !quiet || connString != "InstrumentationKey=env" {
+		t.Errorf("Unexpected values: %s %s %v %s", ikey, role, quiet, connString)
+	}
+}
+
+func TestConfigEnvironmentConnectionString(t *testing.T) {
+	os.Setenv("APPINSIGHTS_INSTRUMENTATIONKEY", "legacy")
+	os.Setenv("AILOG_ENDPOINT", "https://legacy.example.com/")
+	defer os.Unsetenv("APPINSIGHTS_INSTRUMENTATIONKEY")
+	defer os.Unsetenv("AILOG_ENDPOINT")
+
+	path := writeTestConfig(t, "connection-string: InstrumentationKey=file;IngestionEndpoint=https://file.example.com/\n")
+	for _, test := range []struct {
+		args           []string
+		env            string
+		ikey, endpoint string
+	}{
+		// The connection string beats the environment wherever it's from
+		{[]string{"-in", "-", "-connection-string", "InstrumentationKey=cmdline"}, "", "cmdline", defaultIngestionEndpoint + trackPath},
+		{[]string{"-in", "-", "-config", path}, "", "file", "https://file.example.com/v2/track"},
+		{[]string{"-in", "-"}, "InstrumentationKey=env", "env", defaultIngestionEndpoint + trackPath},
+
+		// Explicit options still beat the connection string
+		{[]string{"-in", "-", "-config", path, "-ikey", "explicit"}, "", "explicit", "https://file.example.com/v2/track"},
+
+		// Without one, the environment is used
+		{[]string{"-in", "-"}, "", "legacy", "https://legacy.example.com/"},
+	} {
+		os.Setenv("APPLICATIONINSIGHTS_CONNECTION_STRING", test.env)
+		ldr := &loader{args: test.args, factory: newTestConfigHandler}
+		opts, _, err := ldr.load(flag.NewFlagSet("test", flag.ContinueOnError))
+		if err != nil {
+			t.Errorf("load %v failed: %s", test.args, err.Error())
+			continue
+		}
+
+		if opts.ikey != test.ikey || opts.endpoint != test.endpoint {
+			t.Errorf("load %v gave %q and %q, expected %q and %q", test.args, opts.ikey, opts.endpoint, test.ikey, test.endpoint)
+		}
+	}
+
+	os.Unsetenv("APPLICATIONINSIGHTS_CONNECTION_STRING")
+}
+
+func TestConfigHandlerSelection(t *testing.T) {
+	factories := map[string]HandlerFactory{"test": newTestConfigHandler}
+
+	p, err := newConfigPipeline(0, map[string]interface{}{
+		"handler": "test",
+		"in":      "-",
+		"format":  "$status",
+		"custom":  map[string]interface{}{"pipeline": "first"},
+		"role":    "web",
+	}, nil, nil, factories)
+	if err != nil {
+		t.Fatalf("newConfigPipeline failed: %s", err.Error())
+	}
+
+	if p.handler.(*testConfigHandler).format != "$status" || p.custom["pipeline"] != "first" || p.role != "web" {
+		t.Errorf("Unexpected pipeline: %+v", p)
+	}
+
+	for _, handler := range []interface{}{nil, "bogus"} {
+		values := map[string]interface{}{"in": "-"}
+		if handler != nil {
+			values["handler"] = handler
+		}
+
+		if _, err := newConfigPipeline(0, values, nil, nil, factories); err == nil {
+			t.Errorf("Handler %v should be rejected", handler)
+		}
+	}
+}
+
+func TestConfigPipelineListOptions(t *testing.T) {
+	path := writeTestConfig(t, `
+ikey: test
+include: [zero]
+pipelines:
+  - name: inherits
+    in: /var/log/first.log
+  - name: replaces
+    in: /var/log/second.log
+    include: [one, two]
+  - name: empty
+    in: /var/log/third.log
+    include: []
+`)
+
+	ldr := &loader{args: []string{"-config", path}, factory: newTestConfigHandler}
+	_, pipelines, err := ldr.load(flag.NewFlagSet("test", flag.ContinueOnError))
+	if err != nil {
+		t.Fatalf("load failed: %s", err.Error())
+	}
+
+	// A pipeline's own list replaces the inherited one rather than adding
+	// to it
+	expected := []string{`"zero"`, `"one", "two"`, ""}
+	for i, p := range pipelines {
+		if include := p.handler.(*testConfigHandler).include.String(); include != expected[i] {
+			t.Errorf("Pipeline %s has include %s, expected %s", p.name, include, expected[i])
+		}
+	}
+}
+
+func TestConfigPipelineCommandLine(t *testing.T) {
+	path := writeTestConfig(t, `
+ikey: test
+format: $status
+include: [file]
+pipelines:
+  - name: web
+    in: /var/log/web.log
+  - name: api
+    in: /var/log/api.log
+    format: $request
+`)
+
+	ldr := &loader{
+		args:    []string{"-config", path, "-format", "${cmd}", "-include", "one", "-include", "two", "-noreject"},
+		factory: newTestConfigHandler,
+	}
+	_, pipelines, err := ldr.load(flag.NewFlagSet("test", flag.ContinueOnError))
+	if err != nil {
+		t.Fatalf("load failed: %s", err.Error())
+	}
+
+	// Command line options beat the top level of the file, but not the
+	// pipeline's own options
+	web := pipelines[0].handler.(*testConfigHandler)
+	if web.format != "${cmd}" || web.include.String() != `"one", "two"` || !web.noReject {
+		t.Errorf("Unexpected handler options: %+v", web)
+	}
+
+	api := pipelines[1].handler.(*testConfigHandler)
+	if api.format != "$request" || !api.noReject {
+		t.Errorf("Unexpected handler options: %+v", api)
+	}
+}
+
+func TestConfigPipelineEnvironment(t *testing.T) {
+	path := writeTestConfig(t, `
+ikey: test
+pipelines:
+  - name: web
+    in: /var/log/web.log
+  - name: api
+    in: /var/log/api.log
+    format: $request
+`)
+
+	os.Setenv("AILOG_FORMAT", "${env}")
+	os.Setenv("AILOG_NOREJECT", "true")
+	defer func() {
+		for _, name := range []string{"AILOG_FORMAT", "AILOG_NOREJECT"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	ldr := &loader{args: []string{"-config", path}, factory: newTestConfigHandler}
+	_, pipelines, err := ldr.load(flag.NewFlagSet("test", flag.ContinueOnError))
+	if err != nil {
+		t.Fatalf("load failed: %s", err.Error())
+	}
+
+	web := pipelines[0].handler.(*testConfigHandler)
+	if web.format != "${env}" || !web.noReject {
+		t.Errorf("Unexpected handler options: %+v", web)
+	}
+
+	api := pipelines[1].handler.(*testConfigHandler)
+	if api.format != "$request" || !api.noReject {
+		t.Errorf("Unexpected handler options: %+v", api)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	path := writeTestConfig(t, `
+ikey: test
+format: $status
+custom:
+  env: before
+pipelines:
+  - name: web
+    in: /var/log/web.log
+`)
+
+	ldr := &loader{args: []string{"-config", path}, factory: newTestConfigHandler}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts, pipelines, err := ldr.load(flags)
+	if err != nil {
+		t.Fatalf("load failed: %s", err.Error())
+	}
+
+	fwd, err := newForwarder(opts)
+	if err != nil {
+		t.Fatalf("newForwarder failed: %s", err.Error())
+	}
+
+	p := pipelines[0]
+	p.swap = make(chan *pipeline, 1)
+	p.stopped = make(chan struct{})
+
+	rewrite := func(contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("Failed to write config: %s", err.Error())
+		}
+	}
+
+	// Invalid configurations leave everything alone
+	for _, contents := range []string{
+		"ikey: test\nbogus: 1\npipelines:\n  - name: web\n    in: /var/log/web.log\n",
+		"ikey: other\npipelines:\n  - name: web\n    in: /var/log/web.log\n",
+		"ikey: test\npipelines:\n  - name: web\n    in: /var/log/other.log\n",
+		"ikey: test\nanonip: bogus\npipelines:\n  - name: web\n    in: /var/log/web.log\n",
+	} {
+		rewrite(contents)
+		if err := ldr.reload(opts, pipelines, fwd); err == nil {
+			t.Errorf("Reload should fail for: %s", contents)
+		}
+	}
+
+	if fwd.settings.processors[0].(*contextProcessor).custom["env"] != "before" || len(p.swap) != 0 {
+		t.Fatalf("Failed reload changed settings")
+	}
+
+	rewrite(`
+ikey: test
+format: $request
+custom:
+  env: after
+pipelines:
+  - name: web
+    in: /var/log/web.log
+    role: frontend
+`)
+
+	if err := ldr.reload(opts, pipelines, fwd); err != nil {
+		t.Fatalf("reload failed: %s", err.Error())
+	}
+
+	custom := fwd.settings.processors[0].(*contextProcessor).custom
+	role := p.processors[0].(*contextProcessor).role
+	if custom["env"] != "after" || role != "frontend" {
+		t.Errorf("Unexpected settings after reload: %v %s", custom, role)
+	}
+
+	handler := (<-p.swap).handler.(*testConfigHandler)
+	if handler.format != "$request" {
+		t.Errorf("Unexpected handler after reload: %+v", handler)
+	}
+}
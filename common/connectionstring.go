@@ -0,0 +1,51 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultIngestionEndpoint = "https://dc.services.visualstudio.com/"
+	trackPath                = "v2/track"
+)
+
+// parseConnectionString extracts the instrumentation key and ingestion
+// endpoint from a connection string like
+// 'InstrumentationKey=...;IngestionEndpoint=https://...'
+func parseConnectionString(connectionString string) (string, string, error) {
+	values := make(map[string]string)
+	for _, part := range strings.Split(connectionString, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		eq := strings.IndexByte(part, '=')
+		if eq <= 0 {
+			return "", "", fmt.Errorf("Invalid connection string segment: %s", part)
+		}
+
+		values[strings.ToLower(strings.TrimSpace(part[:eq]))] = strings.TrimSpace(part[eq+1:])
+	}
+
+	ikey := values["instrumentationkey"]
+	if ikey == "" {
+		return "", "", fmt.Errorf("Connection string does not contain an InstrumentationKey")
+	}
+
+	endpoint := values["ingestionendpoint"]
+	if endpoint == "" {
+		if suffix := values["endpointsuffix"]; suffix != "" {
+			endpoint = fmt.Sprintf("https://dc.%s", strings.TrimPrefix(suffix, "."))
+		} else {
+			endpoint = defaultIngestionEndpoint
+		}
+	}
+
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+
+	return ikey, endpoint + trackPath, nil
+}
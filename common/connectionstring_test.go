@@ -0,0 +1,29 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestParseConnectionString(t *testing.T) {
+	cases := [][]string{
+		{"InstrumentationKey=abc", "abc", "https://dc.services.visualstudio.com/v2/track"},
+		{"InstrumentationKey=abc;IngestionEndpoint=https://westus2-1.in.applicationinsights.azure.com/", "abc", "https://westus2-1.in.applicationinsights.azure.com/v2/track"},
+		{" instrumentationkey = abc ; ingestionendpoint=http://localhost:8080 ;", "abc", "http://localhost:8080/v2/track"},
+		{"InstrumentationKey=abc;EndpointSuffix=applicationinsights.us", "abc", "https://dc.applicationinsights.us/v2/track"},
+	}
+
+	for _, c := range cases {
+		ikey, endpoint, err := parseConnectionString(c[0])
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", c[0], err.Error())
+		} else if ikey != c[1] || endpoint != c[2] {
+			t.Errorf("Parsing %q gave %q, %q", c[0], ikey, endpoint)
+		}
+	}
+
+	for _, invalid := range []string{"", "IngestionEndpoint=http://localhost/", "InstrumentationKey"} {
+		if _, _, err := parseConnectionString(invalid); err == nil {
+			t.Errorf("Connection string %q should be rejected", invalid)
+		}
+	}
+}
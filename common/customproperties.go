@@ -27,3 +27,14 @@ func (props *customProperties) Set(value string) error {
 	(*props)[value[0:eq]] = value[eq+1 : len(value)]
 	return nil
 }
+
+type stringList []string
+
+func (lst *stringList) String() string {
+	return strings.Join(*lst, ", ")
+}
+
+func (lst *stringList) Set(value string) error {
+	*lst = append(*lst, value)
+	return nil
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Version is the forwarder's version, set at build time with
+// -ldflags "-X github.com/jjjordanmsft/ApplicationInsights-logforward/common.Version=..."
+var Version = "dev"
+
+const (
+	defaultPodInfo       = "/etc/podinfo"
+	serviceAccountNsFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	cgroupFile           = "/proc/self/cgroup"
+	clientIpTypeProperty = "ClientIP.Type"
+)
+
+var (
+	// Time the process started, for the process enricher
+	processStartTime = time.Now()
+
+	// Container runtimes name cgroups after the 64-character container ID
+	containerIdRE = regexp.MustCompile(`[0-9a-f]{64}`)
+
+	privateNetworks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "fc00::/7", "fe80::/10")
+)
+
+// Kubernetes properties, along with the environment variable and downward API
+// file that each can be read from.
+var kubernetesProperties = []struct {
+	property string
+	env      string
+	file     string
+}{
+	{"Kubernetes.Pod.Name", "POD_NAME", "name"},
+	{"Kubernetes.Pod.Namespace", "POD_NAMESPACE", "namespace"},
+	{"Kubernetes.Node.Name", "NODE_NAME", "nodename"},
+}
+
+// newEnrichers returns processors that add the properties for each of the
+// named enrichers.  Properties that don't change are looked up once.
+func newEnrichers(names []string, podInfo string) (processorChain, error) {
+	static := make(customProperties)
+	var result processorChain
+
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "kubernetes":
+			for k, v := range kubernetesInfo(podInfo) {
+				static[k] = v
+			}
+		case "container":
+			if id := containerId(cgroupFile); id != "" {
+				static["Container.ID"] = id
+			}
+		case "process":
+			static["Process.StartTime"] = processStartTime.UTC().Format(time.RFC3339)
+		case "version":
+			static["Forwarder.Version"] = Version
+		case "iptype":
+			result = append(result, ProcessorFunc(classifyClientIp))
+		default:
+			return nil, fmt.Errorf("Invalid enricher %q, must be one of: kubernetes, container, process, version, iptype", name)
+		}
+	}
+
+	if len(static) > 0 {
+		result = append(processorChain{&contextProcessor{custom: static}}, result...)
+	}
+
+	return result, nil
+}
+
+// kubernetesInfo reads pod properties from environment variables set with
+// the downward API, or failing that, from files in a downward API volume
+// mounted at podInfo.
+func kubernetesInfo(podInfo string) map[string]string {
+	if podInfo == "" {
+		podInfo = defaultPodInfo
+	}
+
+	result := make(map[string]string)
+	for _, prop := range kubernetesProperties {
+		if value := os.Getenv(prop.env); value != "" {
+			result[prop.property] = value
+		} else if value := readTrimmed(filepath.Join(podInfo, prop.file)); value != "" {
+			result[prop.property] = value
+		}
+	}
+
+	if _, ok := result["Kubernetes.Pod.Namespace"]; !ok {
+		if value := readTrimmed(serviceAccountNsFile); value != "" {
+			result["Kubernetes.Pod.Namespace"] = value
+		}
+	}
+
+	if _, ok := result["Kubernetes.Pod.Name"]; !ok && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		// Pods are named by their hostname by default
+		if hostname, err := os.Hostname(); err == nil {
+			result["Kubernetes.Pod.Name"] = hostname
+		}
+	}
+
+	return result
+}
+
+func readTrimmed(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// containerId finds the ID of the container this process runs in from its
+// cgroups, or returns "" if there isn't one.
+func containerId(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+
+	defer f.Close()
+	return parseContainerId(f)
+}
+
+func parseContainerId(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if id := containerIdRE.FindString(scanner.Text()); id != "" {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// classifyClientIp sets a property that says whether the telemetry's client
+// IP address is loopback, private or public.
+func classifyClientIp(item *Item) bool {
+	tags := item.Telemetry.ContextTags()
+	props := item.Telemetry.GetProperties()
+	if tags == nil || props == nil {
+		return true
+	}
+
+	if ip := net.ParseIP(tags[contracts.LocationIp]); ip != nil {
+		props[clientIpTypeProperty] = ipType(ip)
+	}
+
+	return true
+}
+
+func ipType(ip net.IP) string {
+	if ip.IsLoopback() {
+		return "loopback"
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return "private"
+		}
+	}
+
+	return "public"
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var result []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		result = append(result, network)
+	}
+
+	return result
+}
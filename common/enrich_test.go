@@ -0,0 +1,86 @@
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+func TestParseContainerId(t *testing.T) {
+	id := strings.Repeat("0123456789abcdef", 4)
+	tests := map[string]string{
+		"12:memory:/docker/" + id + "\n":                                    id,
+		"0::/kubepods/besteffort/pod1234/cri-containerd-" + id + ".scope\n": id,
+		"11:cpu:/user.slice\n0::/init.scope\n":                              "",
+		"1:name=systemd:/system.slice/docker-" + id + ".scope\n2:cpu:/\n":   id,
+	}
+
+	for cgroup, expected := range tests {
+		if result := parseContainerId(strings.NewReader(cgroup)); result != expected {
+			t.Errorf("parseContainerId(%q): expected %q, got %q", cgroup, expected, result)
+		}
+	}
+}
+
+func TestIpType(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.1":   "loopback",
+		"::1":         "loopback",
+		"10.1.2.3":    "private",
+		"172.20.0.1":  "private",
+		"192.168.1.1": "private",
+		"fd00::1":     "private",
+		"8.8.8.8":     "public",
+		"172.32.0.1":  "public",
+		"2001:db8::1": "public",
+	}
+
+	for ip, expected := range tests {
+		if result := ipType(net.ParseIP(ip)); result != expected {
+			t.Errorf("ipType(%s): expected %s, got %s", ip, expected, result)
+		}
+	}
+}
+
+func TestKubernetesInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podinfo")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "name"), []byte("web-1\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "namespace"), []byte("file-ns"), 0600)
+
+	os.Setenv("POD_NAMESPACE", "env-ns")
+	defer os.Unsetenv("POD_NAMESPACE")
+
+	info := kubernetesInfo(dir)
+	if info["Kubernetes.Pod.Name"] != "web-1" || info["Kubernetes.Pod.Namespace"] != "env-ns" {
+		t.Errorf("Unexpected info: %v", info)
+	}
+}
+
+func TestEnrichers(t *testing.T) {
+	enrichers, err := newEnrichers([]string{"version", "iptype"}, "")
+	if err != nil {
+		t.Fatalf("newEnrichers failed: %s", err.Error())
+	}
+
+	request := appinsights.NewRequestTelemetry("GET", "/", 0, "200")
+	request.Tags.Location().SetIp("10.0.0.1")
+	enrichers.Process(&Item{Telemetry: request})
+
+	if request.Properties["Forwarder.Version"] != Version || request.Properties["ClientIP.Type"] != "private" {
+		t.Errorf("Unexpected properties: %v", request.Properties)
+	}
+
+	if _, err := newEnrichers([]string{"bogus"}, ""); err == nil {
+		t.Error("Unknown enrichers should be rejected")
+	}
+}
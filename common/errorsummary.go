@@ -0,0 +1,77 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Most kinds of errors to list separately in a summary
+const maxSummaryKinds = 10
+
+// errorSummary counts the lines that a handler failed to process, by kind of
+// error, so that they can be reported periodically rather than one by one.
+type errorSummary struct {
+	total    int
+	kinds    []string
+	counts   map[string]int
+	examples map[string]string
+}
+
+func newErrorSummary() *errorSummary {
+	return &errorSummary{
+		counts:   make(map[string]int),
+		examples: make(map[string]string),
+	}
+}
+
+// add counts an error, keeping the first line with each kind of error as an
+// example.
+func (s *errorSummary) add(err error, line string) {
+	kind := errorKind(err)
+	if _, ok := s.counts[kind]; !ok {
+		if len(s.kinds) >= maxSummaryKinds {
+			kind = "Other errors"
+		}
+
+		if _, ok := s.counts[kind]; !ok {
+			s.kinds = append(s.kinds, kind)
+			s.examples[kind] = strings.TrimRight(line, "\r\n")
+		}
+	}
+
+	s.total++
+	s.counts[kind]++
+}
+
+// report writes the summary to msgs, if there were any errors, and resets it.
+// The interval is only used in the message.
+func (s *errorSummary) report(msgs *log.Logger, interval time.Duration) {
+	if s.total == 0 {
+		return
+	}
+
+	if interval > 0 {
+		msgs.Printf("%d lines failed to process in the last %s:", s.total, interval)
+	} else {
+		msgs.Printf("%d lines failed to process:", s.total)
+	}
+
+	for _, kind := range s.kinds {
+		msgs.Printf("  %d x %s. Example: %s", s.counts[kind], kind, s.examples[kind])
+	}
+
+	*s = *newErrorSummary()
+}
+
+// errorKind describes an error without the details that vary from line to
+// line, so that similar errors are counted together.
+func errorKind(err error) string {
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		return NO_MATCH.Error() + " in " + perr.Position()
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorSummary(t *testing.T) {
+	var buf bytes.Buffer
+	msgs := log.New(&buf, "", 0)
+
+	summary := newErrorSummary()
+	summary.report(msgs, time.Minute)
+	if buf.Len() != 0 {
+		t.Errorf("Empty summary shouldn't be reported: %s", buf.String())
+	}
+
+	summary.add(&ParseError{Segment: 1, Variable: "status", Separator: " ", Offset: 10}, "first\n")
+	summary.add(&ParseError{Segment: 1, Variable: "status", Separator: " ", Offset: 12}, "second\n")
+	summary.add(errors.New("Error parsing timestamp"), "third\n")
+	for i := 0; i < maxSummaryKinds; i++ {
+		summary.add(errors.New(strings.Repeat("x", i+1)), "more")
+	}
+
+	summary.report(msgs, time.Minute)
+	expected := []string{
+		"13 lines failed to process in the last 1m0s:",
+		`  2 x Match not found in segment 1 (status): expected " ". Example: first`,
+		"  1 x Error parsing timestamp. Example: third",
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != maxSummaryKinds+2 {
+		t.Fatalf("Unexpected summary:\n%s", buf.String())
+	}
+
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Errorf("Expected %q, got %q", line, lines[i])
+		}
+	}
+
+	if last := lines[len(lines)-1]; last != "  2 x Other errors. Example: more" {
+		t.Errorf("Unexpected last line: %q", last)
+	}
+
+	buf.Reset()
+	summary.report(msgs, time.Minute)
+	if buf.Len() != 0 {
+		t.Errorf("Summary should be reset after reporting: %s", buf.String())
+	}
+}
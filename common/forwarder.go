@@ -0,0 +1,193 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Tracker accepts telemetry produced by a LogHandler.
+type Tracker interface {
+	Track(t appinsights.Telemetry)
+}
+
+// TrackerFunc adapts an ordinary function to a Tracker, e.g. to collect
+// telemetry from a handler in tests.
+type TrackerFunc func(t appinsights.Telemetry)
+
+func (f TrackerFunc) Track(t appinsights.Telemetry) {
+	f(t)
+}
+
+// sink receives a copy of a pipeline's telemetry, after it has been
+// processed, alongside Application Insights.  Send must not block.
+type sink interface {
+	Send(envelope *contracts.Envelope)
+
+	// Close sends what's pending, and returns a channel that is closed once
+	// it's done.
+	Close() <-chan struct{}
+}
+
+// forwarder sends telemetry from every pipeline through a chain of
+// processors, including sampling and redaction, to a single telemetry
+// client.
+type forwarder struct {
+	client   *telemetryClient
+	lock     sync.RWMutex
+	settings *forwarderSettings
+}
+
+// forwarderSettings holds the parts of the forwarder that can be replaced
+// when the configuration is reloaded.
+type forwarderSettings struct {
+	sampling   float64
+	adaptive   float64
+	sampler    sampler
+	processors processorChain
+}
+
+// newForwarder creates a forwarder from the global options.
+func newForwarder(opts *options) (*forwarder, error) {
+	settings, err := newForwarderSettings(opts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tconfig := appinsights.NewTelemetryConfiguration(opts.ikey)
+	if opts.endpoint != "" {
+		tconfig.EndpointUrl = opts.endpoint
+	}
+
+	var channel appinsights.TelemetryChannel
+	if opts.sink != "" {
+		if channel, err = newSinkChannel(opts.sink); err != nil {
+			return nil, fmt.Errorf("Error initializing sink: %s", err.Error())
+		}
+	} else {
+		channel = appinsights.NewInMemoryChannel(tconfig)
+	}
+
+	client := newTelemetryClient(tconfig, channel)
+	if opts.deterministic {
+		for _, tag := range []string{contracts.DeviceId, contracts.DeviceOSVersion, contracts.CloudRoleInstance} {
+			delete(client.context.Tags, tag)
+		}
+
+		idSource = sequentialIds()
+	}
+
+	return &forwarder{
+		client:   client,
+		settings: settings,
+	}, nil
+}
+
+// newForwarderSettings validates the global options that can be reloaded.
+// The sampler in previous is reused if the sampling options haven't changed,
+// so that adaptive sampling keeps its state.
+func newForwarderSettings(opts *options, previous *forwarderSettings) (*forwarderSettings, error) {
+	result := &forwarderSettings{
+		sampling: opts.sampling,
+		adaptive: opts.adaptive,
+	}
+
+	context := &contextProcessor{
+		custom:       opts.custom,
+		role:         opts.role,
+		roleInstance: opts.roleInstance,
+	}
+
+	if !opts.deterministic {
+		hostname, _ := os.Hostname()
+		if context.role == "" {
+			context.role = hostname
+		}
+
+		if context.roleInstance == "" {
+			context.roleInstance = hostname
+		}
+	}
+
+	enrichers, err := newEnrichers(opts.enrich, opts.podInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	result.processors = append(processorChain{context}, enrichers...)
+	result.processors = append(result.processors, registeredProcessors()...)
+
+	if previous != nil && previous.sampling == opts.sampling && previous.adaptive == opts.adaptive {
+		result.sampler = previous.sampler
+	} else {
+		result.sampler, err = newSampler(opts.sampling, opts.adaptive)
+		if err != nil {
+			return nil, fmt.Errorf("Error initializing sampling: %s", err.Error())
+		}
+	}
+
+	if result.sampler != nil {
+		result.processors = append(result.processors, &samplingProcessor{result.sampler})
+	}
+
+	redactor, err := newRedactor(opts.maskParams, opts.scrub, strings.ToLower(opts.anonIp), opts.hashUsers, opts.hashSalt)
+	if err != nil {
+		if result.sampler != nil && (previous == nil || result.sampler != previous.sampler) {
+			stopSampler(result.sampler)
+		}
+
+		return nil, fmt.Errorf("Error initializing redaction: %s", err.Error())
+	}
+
+	if redactor != nil {
+		result.processors = append(result.processors, redactor)
+	}
+
+	return result, nil
+}
+
+// update replaces the forwarder's settings.  Telemetry already being tracked
+// finishes with the old ones.
+func (fwd *forwarder) update(settings *forwarderSettings) {
+	fwd.lock.Lock()
+	previous := fwd.settings
+	fwd.settings = settings
+	fwd.lock.Unlock()
+
+	if previous.sampler != nil && previous.sampler != settings.sampler {
+		stopSampler(previous.sampler)
+	}
+}
+
+func stopSampler(s sampler) {
+	if adaptive, ok := s.(*adaptiveSampler); ok {
+		adaptive.Stop()
+	}
+}
+
+// send runs the item through the processors and, unless one of them drops
+// it, hands it to the telemetry client and the sinks.
+func (fwd *forwarder) send(item *Item, sinks []sink) {
+	fwd.lock.RLock()
+	settings := fwd.settings
+	fwd.lock.RUnlock()
+
+	if !settings.processors.Process(item) {
+		return
+	}
+
+	if len(sinks) == 0 {
+		fwd.client.Track(item.Telemetry, item.SampleRate)
+		return
+	}
+
+	envelope := fwd.client.envelop(item.Telemetry, item.SampleRate)
+	fwd.client.channel.Send(envelope)
+	for _, s := range sinks {
+		s.Send(envelope)
+	}
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Prefix of -in for a pipeline that receives HTTP requests
+const httpInputPrefix = "http:"
+
+// Longest time to wait for requests being served when an HTTP input closes
+const httpShutdownWait = 5 * time.Second
+
+// isHttpInput returns whether the input is an address to receive HTTP
+// requests on rather than a file.
+func isHttpInput(infile string) bool {
+	return strings.HasPrefix(infile, httpInputPrefix)
+}
+
+// listenHttp serves HTTP requests on the address in infile with handler, in
+// place of reading lines.  The reader never sends any; it closes once Close
+// is called and the requests being served have finished, or if the server
+// fails.
+func listenHttp(infile string, handler http.Handler) (*LogReader, error) {
+	address := strings.TrimPrefix(infile, httpInputPrefix)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening on %s: %s", address, err.Error())
+	}
+
+	result := &LogReader{
+		events:  make(chan LogEventMessage),
+		control: make(chan LogControlMessage),
+		done:    make(chan struct{}),
+		stats:   &readerStats{},
+	}
+
+	server := &http.Server{Handler: handler}
+	failed := make(chan error, 1)
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
+
+	go func() {
+		var err error
+	loop:
+		for {
+			select {
+			case ctl := <-result.control:
+				// There's nothing to reopen on reset
+				if ctl.close {
+					ctx, cancel := context.WithTimeout(context.Background(), httpShutdownWait)
+					server.Shutdown(ctx)
+					cancel()
+					break loop
+				}
+			case err = <-failed:
+				break loop
+			}
+		}
+
+		result.closed = true
+		result.events <- LogEventMessage{err: err, closed: true}
+		close(result.done)
+	}()
+
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestListenHttp(t *testing.T) {
+	// Find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err.Error())
+	}
+
+	address := l.Addr().String()
+	l.Close()
+
+	reader, err := listenHttp(httpInputPrefix+address, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	if err != nil {
+		t.Fatalf("listenHttp failed: %s", err.Error())
+	}
+
+	if _, err := listenHttp(httpInputPrefix+address, http.NotFoundHandler()); err == nil {
+		t.Error("Expected an error listening on the same address twice")
+	}
+
+	// Resets are ignored
+	reader.Reset()
+
+	response, err := http.Get("http://" + address + "/v1/traces")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err.Error())
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "/v1/traces" {
+		t.Errorf("Unexpected response: %s", body)
+	}
+
+	reader.Close()
+	if event := nextEvent(t, reader); !event.closed || event.err != nil {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	// Once closed, these don't block
+	reader.Close()
+	reader.Reset()
+
+	if _, err := http.Get("http://" + address + "/"); err == nil {
+		t.Error("Server is still listening after Close")
+	}
+}
@@ -13,117 +13,257 @@ import (
 	"github.com/microsoft/ApplicationInsights-Go/appinsights"
 )
 
+// LogHandler turns log lines into telemetry.  Handlers that implement
+// io.Closer are closed when their input closes or the configuration is
+// reloaded.  Handlers that implement http.Handler can also be given
+// requests from an 'http:' input instead of lines.
 type LogHandler interface {
-	Initialize(*log.Logger) error
+	Initialize(*log.Logger, Tracker) error
 	Receive(string) error
 }
 
-var (
-	flagIkey         string
-	flagEndpoint     string
-	flagRole         string
-	flagRoleInstance string
-	flagInfile       string
-	flagOutfile      string
-	flagCustom       customProperties
-	flagFlushWait    time.Duration
-	flagDebug        bool
-	flagQuiet        bool
-
-	tclient appinsights.TelemetryClient
-)
+// PartialLineHandler is a LogHandler that marks telemetry from partial
+// lines, which are the last bytes of an input that ended without a newline,
+// or that waited longer than -idleflush for one.  ReceivePartial is called
+// for those lines instead of Receive.  Telemetry from a ConcurrentHandler is
+// marked by the pipeline instead.
+type PartialLineHandler interface {
+	LogHandler
+	ReceivePartial(string) error
+}
+
+// Property of telemetry from partial lines, set to "true"
+const PartialLineProperty = "PartialLine"
+
+// HandlerFactory creates a new LogHandler and registers its options in flags.
+// It is called once for the command line and once per configured pipeline.
+type HandlerFactory func(flags *flag.FlagSet) LogHandler
 
-func InitFlags() {
-	flag.StringVar(&flagIkey, "ikey", "", "ApplicationInsights instrumentation key (required)")
-	flag.StringVar(&flagEndpoint, "endpoint", "", "ApplicationInsights ingestion endpoint")
-	flag.StringVar(&flagRole, "role", "", "Telemetry role name. Defaults to the machine hostname")
-	flag.StringVar(&flagRoleInstance, "roleinstance", "", "Telemetry role instance. Defaults to the machine hostname")
-	flag.StringVar(&flagInfile, "in", "", "Input file, or '-' for stdin (required)")
-	flag.StringVar(&flagOutfile, "out", "", "Output file, '-' for stdout, 'stderr' for stderr")
-	flag.DurationVar(&flagFlushWait, "flush", 3*time.Second, "Timeout to flush telemetry when shutting down")
-	flag.BoolVar(&flagDebug, "debug", false, "Show debugging output")
-	flag.BoolVar(&flagQuiet, "quiet", false, "Don't write any output messages")
-	flag.Var(&flagCustom, "custom", "Include custom property in telemetry like 'key=value'. Can be used multiple times")
+// Run parses the command line and configuration file, then forwards logs
+// until all inputs are closed or the process is signaled.
+func Run(name string, factory HandlerFactory) {
+	run(name, factory, nil)
 }
 
-func Start(name string, logHandler LogHandler) {
-	if flagDebug {
-		log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-		appinsights.NewDiagnosticsMessageListener(writeAiLog)
-	} else {
-		log.SetOutput(ioutil.Discard)
+// RunMultiple is like Run, but hosts several kinds of handlers.  Each
+// pipeline in the configuration file selects one with its handler option.
+func RunMultiple(name string, factories map[string]HandlerFactory) {
+	run(name, nil, factories)
+}
+
+func run(name string, factory HandlerFactory, factories map[string]HandlerFactory) {
+	ldr := &loader{
+		args:      os.Args[1:],
+		factory:   factory,
+		factories: factories,
 	}
 
-	if flagInfile == "" {
-		fmt.Fprintln(os.Stderr, "Must specify input file. See -help for usage.")
+	opts, pipelines, err := ldr.load(flag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
-	hostname, _ := os.Hostname()
-	if flagRole == "" {
-		flagRole = hostname
+	start(name, ldr, opts, pipelines)
+}
+
+// loader reads options and pipelines from the command line, configuration
+// file and environment.  It is kept so that the configuration can be
+// reloaded.
+type loader struct {
+	args      []string
+	factory   HandlerFactory
+	factories map[string]HandlerFactory
+}
+
+func (ldr *loader) load(flags *flag.FlagSet) (*options, []*pipeline, error) {
+	opts := &options{}
+	opts.register(flags)
+
+	factory := ldr.factory
+	if ldr.factories != nil {
+		flags.String("handler", "", fmt.Sprintf("Log handler for -in: %s", handlerNames(ldr.factories)))
+
+		name, err := handlerName(ldr.args)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if name != "" {
+			if factory = ldr.factories[name]; factory == nil {
+				return nil, nil, fmt.Errorf("Invalid handler %q, must be one of: %s", name, handlerNames(ldr.factories))
+			}
+		}
 	}
 
-	if flagRoleInstance == "" {
-		flagRoleInstance = hostname
+	var handler LogHandler
+	if factory != nil {
+		handler = factory(flags)
 	}
 
-	if flagIkey == "" {
-		fmt.Fprintln(os.Stderr, "Must specify instrumentation key. See -help for usage.")
-		os.Exit(1)
+	if err := flags.Parse(ldr.args); err != nil {
+		return nil, nil, err
 	}
 
-	tconfig := appinsights.NewTelemetryConfiguration(flagIkey)
-	if flagEndpoint != "" {
-		tconfig.EndpointUrl = flagEndpoint
+	cmdline := commandLineArgs(flags, ldr.args)
+
+	if opts.config == "" {
+		opts.config = os.Getenv(envName("config"))
 	}
 
-	tclient = appinsights.NewTelemetryClientFromConfig(tconfig)
+	var config *configFile
+	if opts.config != "" {
+		var err error
+		if config, err = loadConfig(opts.config); err != nil {
+			return nil, nil, fmt.Errorf("Error loading configuration: %s", err.Error())
+		}
 
-	// Propagate custom flags to common properties
-	for k, v := range flagCustom {
-		tclient.Context().CommonProperties[k] = v
+		// Command line options take precedence over the file
+		skip := setFlags(flags)
+		skip["config"] = true
+		if err := applyConfig(flags, config.values, skip); err != nil {
+			return nil, nil, fmt.Errorf("Error loading configuration: %s", err.Error())
+		}
 	}
 
-	msgs := log.New(os.Stderr, fmt.Sprintf("%s: ", name), log.Ldate|log.Ltime)
-	if flagQuiet {
-		msgs.SetOutput(ioutil.Discard)
+	if err := applyEnvironment(flags); err != nil {
+		return nil, nil, err
 	}
 
-	cloud := tclient.Context().Tags.Cloud()
-	cloud.SetRole(flagRole)
-	cloud.SetRoleInstance(flagRoleInstance)
+	var pipelines []*pipeline
+	if config != nil {
+		defaults := pipelineDefaults(config.values, cmdline)
+		for i, values := range config.pipelines {
+			p, err := newConfigPipeline(i, values, defaults, ldr.factory, ldr.factories)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error loading configuration: %s", err.Error())
+			}
 
-	var logWriter *LogWriter
-	if flagOutfile != "" {
-		var err error
-		logWriter, err = NewLogWriter(flagOutfile)
-		if err != nil {
-			msgs.Printf("Error initializing log writer: %s\n", err.Error())
-			os.Exit(1)
+			pipelines = append(pipelines, p)
 		}
-	} else {
-		logWriter = NewNilLogWriter()
 	}
 
-	logReader, err := MakeLogReader(flagInfile)
+	if opts.infile != "" {
+		if handler == nil {
+			return nil, nil, fmt.Errorf("Must specify -handler for the input file. See -help for usage.")
+		}
+
+		pipelines = append([]*pipeline{{
+			infile:          opts.infile,
+			outfile:         opts.outfile,
+			output:          opts.output,
+			mirror:          opts.mirror,
+			deadLetterFile:  opts.deadLetter,
+			forwardRejected: opts.forwardRejected,
+			handler:         handler,
+		}}, pipelines...)
+	}
+
+	if len(pipelines) == 0 {
+		return nil, nil, fmt.Errorf("Must specify input file. See -help for usage.")
+	}
+
+	if err := opts.resolveEndpoint(); err != nil {
+		return nil, nil, err
+	}
+
+	return opts, pipelines, nil
+}
+
+// reload reads the configuration again and applies it to the running
+// forwarder and pipelines.  Nothing is changed if the new configuration is
+// invalid.  Inputs, outputs and the destination can't be changed without a
+// restart.
+func (ldr *loader) reload(opts *options, pipelines []*pipeline, fwd *forwarder) error {
+	flags := flag.NewFlagSet("reload", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	nextOpts, next, err := ldr.load(flags)
 	if err != nil {
-		msgs.Printf("Error initializing log reader: %s\n", err.Error())
-		os.Exit(1)
+		return err
+	}
+
+	if nextOpts.ikey != opts.ikey || nextOpts.endpoint != opts.endpoint || nextOpts.sink != opts.sink || nextOpts.deterministic != opts.deterministic {
+		return fmt.Errorf("Changing the instrumentation key, endpoint, sink or -deterministic requires a restart")
+	}
+
+	if nextOpts.workers != opts.workers || nextOpts.lineLimits() != opts.lineLimits() {
+		return fmt.Errorf("Changing -workers, -maxline, -longlines or -idleflush requires a restart")
+	}
+
+	if len(next) != len(pipelines) {
+		return fmt.Errorf("Adding or removing pipelines requires a restart")
+	}
+
+	for i, p := range pipelines {
+		if !p.sameInput(next[i]) {
+			return fmt.Errorf("Changing the name, input or output of a pipeline requires a restart")
+		}
+	}
+
+	fwd.lock.RLock()
+	previous := fwd.settings
+	fwd.lock.RUnlock()
+
+	settings, err := newForwarderSettings(nextOpts, previous)
+	if err != nil {
+		return err
 	}
 
-	err = logHandler.Initialize(msgs)
+	for i, p := range pipelines {
+		if err := p.prepare(next[i]); err != nil {
+			for _, n := range next[:i] {
+				closeHandler(n.handler)
+			}
+
+			if settings.sampler != previous.sampler {
+				stopSampler(settings.sampler)
+			}
+
+			return err
+		}
+	}
+
+	fwd.update(settings)
+	for i, p := range pipelines {
+		p.reload(next[i])
+	}
+
+	return nil
+}
+
+func start(name string, ldr *loader, opts *options, pipelines []*pipeline) {
+	if opts.debug {
+		log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+		appinsights.NewDiagnosticsMessageListener(writeAiLog)
+	} else {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	fwd, err := newForwarder(opts)
 	if err != nil {
-		msgs.Printf("Error initializing log handler: %s\n", err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
+	msgs := log.New(os.Stderr, fmt.Sprintf("%s: ", name), log.Ldate|log.Ltime)
+	if opts.quiet {
+		msgs.SetOutput(ioutil.Discard)
+	}
+
 	signalc := make(chan os.Signal, 2)
 	signal.Notify(signalc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-	done := make(chan bool)
-	go readLoop(logReader, logWriter, logHandler, msgs, done)
+	done := make(chan *pipeline, len(pipelines))
+	for _, p := range pipelines {
+		if err := p.start(name, opts, fwd, done); err != nil {
+			msgs.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+	}
 
+	channel := fwd.client.Channel()
+	running := len(pipelines)
 	for {
 		select {
 		case sig := <-signalc:
@@ -131,39 +271,60 @@ func Start(name string, logHandler LogHandler) {
 			switch sig {
 			case syscall.SIGHUP:
 				msgs.Println("Resetting logfile")
-				logReader.Reset()
+				for _, p := range pipelines {
+					p.logReader.Reset()
+					p.resetOutputs()
+				}
+
+				msgs.Println("Reloading configuration")
+				if err := ldr.reload(opts, pipelines, fwd); err != nil {
+					msgs.Printf("Error reloading configuration, keeping the previous one: %s", err.Error())
+				}
 			case syscall.SIGINT, syscall.SIGTERM:
-				logReader.Close()
+				for _, p := range pipelines {
+					p.logReader.Close()
+				}
+
+				// Wait for the pipelines to track the lines they've read
+				timeout := time.After(opts.flushWait)
+			wait:
+				for running > 0 {
+					select {
+					case <-done:
+						running--
+					case <-timeout:
+						break wait
+					}
+				}
 
 				// Begin flush of AI client
-				tclient.Channel().Flush()
+				channel.Flush()
 
-				// Wait for done
-				select {
-				case <-done:
-					break
-				case <-time.After(time.Duration(250 * time.Millisecond)):
-					break
+				for _, p := range pipelines {
+					p.logWriter.Close()
 				}
 
-				logWriter.Close()
-
 				// Close down telemetry channel and try to send out any remaining events.
 				select {
-				case <-tclient.Channel().Close(flagFlushWait):
+				case <-channel.Close(opts.flushWait):
 					break
-				case <-time.After(flagFlushWait):
+				case <-time.After(opts.flushWait):
 					break
 				}
 
 				os.Exit(-int(sig.(syscall.Signal)))
 			}
 		case <-done:
+			running--
+			if running > 0 {
+				break
+			}
+
 			// Flush out events and close down AI sender.
 			select {
-			case <-tclient.Channel().Close(flagFlushWait):
+			case <-channel.Close(opts.flushWait):
 				break
-			case <-time.After(flagFlushWait):
+			case <-time.After(opts.flushWait):
 				break
 			}
 
@@ -172,51 +333,6 @@ func Start(name string, logHandler LogHandler) {
 	}
 }
 
-func readLoop(logReader *LogReader, logWriter *LogWriter, logHandler LogHandler, msgs *log.Logger, done chan bool) {
-main:
-	for {
-		select {
-		case event := <-logReader.events:
-			if event.data != "" {
-				if logWriter != nil {
-					logWriter.Write(event.data)
-				}
-
-				err := logHandler.Receive(event.data)
-				if err != nil {
-					msgs.Println(fmt.Sprintf("Error processing log line. Error: %s Original log line: %s", err.Error(), event.data))
-				}
-			}
-
-			if event.err != nil {
-				msgs.Println(event.err.Error())
-			}
-
-			if event.closed {
-				msgs.Println("Input closed.")
-				break main
-			}
-		case event := <-logWriter.events:
-			if event.err != nil {
-				msgs.Printf("Log output encountered error: %s", event.err.Error())
-			}
-
-			if event.closed {
-				msgs.Println("Log output closed. Aborting.")
-				break main
-			}
-		}
-	}
-
-	done <- true
-}
-
-func Track(t appinsights.Telemetry) {
-	if t != nil {
-		tclient.Track(t)
-	}
-}
-
 func writeAiLog(msg string) error {
 	log.Println(msg)
 	return nil
@@ -0,0 +1,326 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Longest wait between retries of a batch
+const maxRetryWait = 30 * time.Second
+
+// mirrorSettings holds a pipeline's -mirror options: the sinks that get a
+// copy of its telemetry, and how each of them batches and retries it.
+type mirrorSettings struct {
+	targets   stringList
+	batchSize int
+	interval  time.Duration
+	retries   int
+}
+
+func (settings *mirrorSettings) register(flags *flag.FlagSet) {
+	flags.Var(&settings.targets, "mirror", "Also send telemetry to 'file:path', 'webhook:URL' or 'otlp:URL'. Can be used multiple times")
+	flags.IntVar(&settings.batchSize, "mirrorbatch", 100, "Most telemetry items each -mirror sink sends at once")
+	flags.DurationVar(&settings.interval, "mirrorinterval", 5*time.Second, "Longest time each -mirror sink holds telemetry before sending it")
+	flags.IntVar(&settings.retries, "mirrorretries", 3, "Times each -mirror sink retries a batch that failed to send, waiting longer each time")
+}
+
+// equal returns whether the settings are the same as other's.
+func (settings *mirrorSettings) equal(other *mirrorSettings) bool {
+	return settings.targets.String() == other.targets.String() &&
+		settings.batchSize == other.batchSize &&
+		settings.interval == other.interval &&
+		settings.retries == other.retries
+}
+
+// newSinks creates a sink for each -mirror target.  Errors while sending are
+// written to msgs.
+func (settings *mirrorSettings) newSinks(msgs *log.Logger) ([]sink, error) {
+	if settings.batchSize < 1 || settings.interval <= 0 || settings.retries < 0 {
+		return nil, fmt.Errorf("-mirrorbatch and -mirrorinterval must be positive, and -mirrorretries can't be negative")
+	}
+
+	var result []sink
+	for _, target := range settings.targets {
+		exporter, err := newExporter(target)
+		if err != nil {
+			closeSinks(result, 0)
+			return nil, err
+		}
+
+		result = append(result, newBatchingSink(target, exporter, settings, msgs))
+	}
+
+	return result, nil
+}
+
+// newExporter creates the exporter for a -mirror target.
+func newExporter(target string) (exporter, error) {
+	scheme := strings.SplitN(target, ":", 2)[0]
+	address := strings.TrimPrefix(target, scheme+":")
+
+	switch scheme {
+	case "file":
+		if address == "" {
+			break
+		}
+
+		return &fileExporter{path: address}, nil
+	case "webhook", "otlp":
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid -mirror %q, must have an http or https URL", target)
+		}
+
+		if scheme == "webhook" {
+			return &webhookExporter{url: address, client: &http.Client{Timeout: 30 * time.Second}}, nil
+		}
+
+		return newOtlpExporter(address), nil
+	}
+
+	return nil, fmt.Errorf("Invalid -mirror %q, must be file:path, webhook:URL or otlp:URL", target)
+}
+
+// closeSinks flushes the sinks, waiting up to timeout for them.
+func closeSinks(sinks []sink, timeout time.Duration) {
+	expired := time.After(timeout)
+	for _, s := range sinks {
+		select {
+		case <-s.Close():
+		case <-expired:
+			return
+		}
+	}
+}
+
+// exporter writes batches of telemetry somewhere for a batchingSink.  It
+// returns the envelopes that still need to be sent if it fails, e.g. only
+// part of the batch.  Wrap the error in permanentError if retrying won't
+// help.
+type exporter interface {
+	export(batch []*contracts.Envelope) ([]*contracts.Envelope, error)
+	close()
+}
+
+// permanentError is an error that retrying won't fix.
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string {
+	return err.err.Error()
+}
+
+// batchingSink queues telemetry for an exporter on its own goroutine, and
+// sends it in batches when there are enough, or every interval.  Batches
+// that fail are retried with increasing waits.  If the exporter falls
+// behind, telemetry is dropped rather than holding up the pipeline, and the
+// number dropped is reported every interval.
+type batchingSink struct {
+	name      string
+	exporter  exporter
+	batchSize int
+	interval  time.Duration
+	retries   int
+	msgs      *log.Logger
+
+	lock    sync.RWMutex
+	queue   chan *contracts.Envelope
+	closed  bool
+	done    chan struct{}
+	dropped int64
+}
+
+// Batches that can be queued while one is being sent
+const queuedBatches = 10
+
+func newBatchingSink(name string, exporter exporter, settings *mirrorSettings, msgs *log.Logger) *batchingSink {
+	result := &batchingSink{
+		name:      name,
+		exporter:  exporter,
+		batchSize: settings.batchSize,
+		interval:  settings.interval,
+		retries:   settings.retries,
+		msgs:      msgs,
+		queue:     make(chan *contracts.Envelope, settings.batchSize*queuedBatches),
+		done:      make(chan struct{}),
+	}
+
+	go result.run()
+	return result
+}
+
+func (s *batchingSink) Send(envelope *contracts.Envelope) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.queue <- envelope:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// Close sends what's queued, and returns a channel that is closed once it's
+// done.
+func (s *batchingSink) Close() <-chan struct{} {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+
+	return s.done
+}
+
+func (s *batchingSink) run() {
+	defer close(s.done)
+	defer s.exporter.close()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var batch []*contracts.Envelope
+	for {
+		select {
+		case envelope, ok := <-s.queue:
+			if !ok {
+				s.send(batch)
+				s.reportDropped()
+				return
+			}
+
+			batch = append(batch, envelope)
+			if len(batch) >= s.batchSize {
+				s.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			s.send(batch)
+			batch = nil
+			s.reportDropped()
+		}
+	}
+}
+
+// send exports the batch, retrying what fails.
+func (s *batchingSink) send(batch []*contracts.Envelope) {
+	wait := time.Second
+	for attempt := 0; len(batch) > 0; attempt++ {
+		var err error
+		if batch, err = s.exporter.export(batch); err == nil {
+			return
+		}
+
+		if _, ok := err.(permanentError); ok || attempt >= s.retries {
+			s.msgs.Printf("Error sending %d telemetry items to %s, dropping them: %s", len(batch), s.name, err.Error())
+			return
+		}
+
+		s.msgs.Printf("Error sending %d telemetry items to %s, retrying in %s: %s", len(batch), s.name, wait, err.Error())
+		time.Sleep(wait)
+		if wait *= 2; wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+	}
+}
+
+func (s *batchingSink) reportDropped() {
+	if dropped := atomic.SwapInt64(&s.dropped, 0); dropped > 0 {
+		s.msgs.Printf("Dropped %d telemetry items for %s because it fell behind", dropped, s.name)
+	}
+}
+
+// fileExporter appends envelopes to a file, one JSON object per line, like
+// -sink does.  The file is opened for each batch, so it can be rotated by
+// moving it.
+type fileExporter struct {
+	path string
+}
+
+func (exp *fileExporter) export(batch []*contracts.Envelope) ([]*contracts.Envelope, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, envelope := range batch {
+		if err := encoder.Encode(envelope); err != nil {
+			return batch, permanentError{err}
+		}
+	}
+
+	file, err := os.OpenFile(exp.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return batch, err
+	}
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return batch, err
+	}
+
+	return nil, file.Close()
+}
+
+func (exp *fileExporter) close() {
+}
+
+// webhookExporter posts each batch to a URL as a JSON array of envelopes.
+type webhookExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (exp *webhookExporter) export(batch []*contracts.Envelope) ([]*contracts.Envelope, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return batch, permanentError{err}
+	}
+
+	if err := postJSON(exp.client, exp.url, body); err != nil {
+		return batch, err
+	}
+
+	return nil, nil
+}
+
+func (exp *webhookExporter) close() {
+}
+
+// postJSON posts the body to the URL.  Responses other than success are
+// errors, which are permanent unless the request may succeed later.
+func postJSON(client *http.Client, url string, body []byte) error {
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	err = fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+	if response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return err
+	}
+
+	return permanentError{err}
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common/otlpmodel"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// newMirrorPipeline returns a pipeline that mirrors its telemetry to the
+// targets, and sends the rest to a sink file in dir.
+func newMirrorPipeline(t *testing.T, dir string, settings mirrorSettings) *pipeline {
+	fwd, err := newForwarder(&options{sink: "file:" + filepath.Join(dir, "telemetry.jsonl"), role: "web", roleInstance: "web-1"})
+	if err != nil {
+		t.Fatalf("newForwarder failed: %s", err.Error())
+	}
+
+	msgs := log.New(ioutil.Discard, "", 0)
+	sinks, err := settings.newSinks(msgs)
+	if err != nil {
+		t.Fatalf("newSinks failed: %s", err.Error())
+	}
+
+	return &pipeline{msgs: msgs, forwarder: fwd, sinks: sinks}
+}
+
+func TestMirrorFileAndWebhook(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	mirrorPath := filepath.Join(dir, "mirror.jsonl")
+
+	// The webhook fails once, so its batch is retried
+	var lock sync.Mutex
+	var posts [][]map[string]interface{}
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var batch []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("Invalid webhook body: %s", err.Error())
+		}
+
+		posts = append(posts, batch)
+	}))
+	defer server.Close()
+
+	settings := mirrorSettings{
+		targets:   stringList{"file:" + mirrorPath, "webhook:" + server.URL},
+		batchSize: 2,
+		interval:  time.Minute,
+		retries:   1,
+	}
+
+	p := newMirrorPipeline(t, dir, settings)
+	for i := 0; i < 3; i++ {
+		p.Track(appinsights.NewTraceTelemetry(fmt.Sprintf("message %d", i), appinsights.Information))
+	}
+
+	closeSinks(p.sinks, 10*time.Second)
+	<-p.forwarder.client.Channel().Close()
+
+	data, _ := ioutil.ReadFile(mirrorPath)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[2], `"message":"message 2"`) || !strings.Contains(lines[0], `"ai.cloud.role":"web"`) {
+		t.Errorf("Unexpected mirror file: %s", data)
+	}
+
+	// Application Insights gets the same telemetry
+	if sent, _ := ioutil.ReadFile(filepath.Join(dir, "telemetry.jsonl")); string(sent) != string(data) {
+		t.Errorf("Mirror differs from telemetry sent:\n%s\n%s", data, sent)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(posts) != 2 || len(posts[0]) != 2 || len(posts[1]) != 1 {
+		t.Fatalf("Expected batches of 2 and 1, got %v", posts)
+	}
+}
+
+func TestMirrorInvalid(t *testing.T) {
+	msgs := log.New(ioutil.Discard, "", 0)
+	for _, target := range []string{"file:", "webhook:ftp://host", "otlp:", "kafka:host"} {
+		settings := mirrorSettings{targets: stringList{target}, batchSize: 1, interval: time.Second}
+		if _, err := settings.newSinks(msgs); err == nil {
+			t.Errorf("Expected an error for %q", target)
+		}
+	}
+}
+
+// testExporter fails as told, and records what it exported.
+type testExporter struct {
+	lock     sync.Mutex
+	failures []error
+	exported []*contracts.Envelope
+}
+
+func (exp *testExporter) export(batch []*contracts.Envelope) ([]*contracts.Envelope, error) {
+	exp.lock.Lock()
+	defer exp.lock.Unlock()
+	if len(exp.failures) > 0 {
+		err := exp.failures[0]
+		exp.failures = exp.failures[1:]
+		return batch, err
+	}
+
+	exp.exported = append(exp.exported, batch...)
+	return nil, nil
+}
+
+func (exp *testExporter) close() {
+}
+
+func TestBatchingSinkRetries(t *testing.T) {
+	for _, test := range []struct {
+		failures []error
+		exported int
+	}{
+		{nil, 1},
+		{[]error{fmt.Errorf("Unavailable")}, 1},
+		{[]error{fmt.Errorf("Unavailable"), fmt.Errorf("Unavailable")}, 0},
+		{[]error{permanentError{fmt.Errorf("Bad request")}}, 0},
+	} {
+		exp := &testExporter{failures: test.failures}
+		s := newBatchingSink("test", exp, &mirrorSettings{batchSize: 10, interval: time.Minute, retries: 1}, log.New(ioutil.Discard, "", 0))
+		s.Send(contracts.NewEnvelope())
+		<-s.Close()
+
+		// Sending after closing is ignored
+		s.Send(contracts.NewEnvelope())
+		if len(exp.exported) != test.exported {
+			t.Errorf("With failures %v, expected %d exported, got %d", test.failures, test.exported, len(exp.exported))
+		}
+	}
+}
+
+func TestOtlpExporter(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	received := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		received[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	p := newMirrorPipeline(t, dir, mirrorSettings{targets: stringList{"otlp:" + server.URL + "/"}, batchSize: 10, interval: time.Minute})
+
+	request := appinsights.NewRequestTelemetry("GET", "http://example.com/path", 1500*time.Millisecond, "404")
+	request.Timestamp = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	request.Tags.Operation().SetId("0123456789abcdef0123456789abcdef")
+	request.Properties["key"] = "value"
+	p.Track(request)
+	p.Track(appinsights.NewRemoteDependencyTelemetry("query", "SQL", "db", true))
+	p.Track(appinsights.NewTraceTelemetry("hello", appinsights.Warning))
+	p.Track(appinsights.NewMetricTelemetry("skipped", 1))
+
+	closeSinks(p.sinks, 10*time.Second)
+	<-p.forwarder.client.Channel().Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var traces otlpmodel.ExportRequest
+	if err := json.Unmarshal(received["/v1/traces"], &traces); err != nil {
+		t.Fatalf("Invalid traces: %s %s", err.Error(), received["/v1/traces"])
+	}
+
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans[0].Spans) != 2 || traces.ResourceLogs != nil {
+		t.Fatalf("Expected 2 spans: %s", received["/v1/traces"])
+	}
+
+	resource := traces.ResourceSpans[0].Resource
+	if len(resource.Attributes) != 2 || *resource.Attributes[0].Value.StringValue != "web" || *resource.Attributes[1].Value.StringValue != "web-1" {
+		t.Errorf("Unexpected resource: %s", received["/v1/traces"])
+	}
+
+	span := traces.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	start := request.Timestamp.UnixNano()
+	if span.Kind != otlpmodel.SpanKindServer || span.Name != "GET http://example.com/path" || span.TraceId != "0123456789abcdef0123456789abcdef" ||
+		len(span.SpanId) != 16 || span.Status.Code != otlpmodel.StatusError ||
+		int64(span.StartTimeUnixNano) != start || int64(span.EndTimeUnixNano) != start+int64(1500*time.Millisecond) {
+		t.Errorf("Unexpected request span: %+v", span)
+	}
+
+	attributes := make(map[string]otlpmodel.AnyValue)
+	for _, kv := range span.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+
+	if v := attributes["key"].StringValue; v == nil || *v != "value" {
+		t.Errorf("Missing custom property: %s", received["/v1/traces"])
+	}
+
+	if v := attributes["http.response.status_code"].IntValue; v == nil || *v != 404 {
+		t.Errorf("Missing status code: %s", received["/v1/traces"])
+	}
+
+	if dependency := traces.ResourceSpans[0].ScopeSpans[0].Spans[1]; dependency.Kind != otlpmodel.SpanKindClient || dependency.Status.Code != otlpmodel.StatusOk {
+		t.Errorf("Unexpected dependency span: %+v", dependency)
+	}
+
+	var logs otlpmodel.ExportRequest
+	if err := json.Unmarshal(received["/v1/logs"], &logs); err != nil {
+		t.Fatalf("Invalid logs: %s %s", err.Error(), received["/v1/logs"])
+	}
+
+	if len(logs.ResourceLogs) != 1 || len(logs.ResourceLogs[0].ScopeLogs[0].LogRecords) != 1 {
+		t.Fatalf("Expected 1 log record: %s", received["/v1/logs"])
+	}
+
+	record := logs.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if *record.Body.StringValue != "hello" || record.SeverityNumber != 13 || len(record.TraceId) != 32 {
+		t.Errorf("Unexpected log record: %s", received["/v1/logs"])
+	}
+}
+
+func TestParseAIDuration(t *testing.T) {
+	for text, expected := range map[string]time.Duration{
+		"00:00:01.5000000":   1500 * time.Millisecond,
+		"01:02:03":           time.Hour + 2*time.Minute + 3*time.Second,
+		"2.00:00:00.0000010": 48*time.Hour + time.Microsecond,
+		"invalid":            0,
+	} {
+		if actual := parseAIDuration(text); actual != expected {
+			t.Errorf("parseAIDuration(%q) = %s, expected %s", text, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// options holds the settings that apply to the whole process rather than a
+// single pipeline.
+type options struct {
+	ikey            string
+	connString      string
+	endpoint        string
+	role            string
+	roleInstance    string
+	infile          string
+	outfile         string
+	output          OutputSettings
+	mirror          mirrorSettings
+	deadLetter      string
+	forwardRejected bool
+	custom          customProperties
+	flushWait       time.Duration
+	errorSummary    time.Duration
+	workers         int
+	maxLine         int
+	longLines       longLineMode
+	idleFlush       time.Duration
+	debug           bool
+	quiet           bool
+	sampling        float64
+	adaptive        float64
+	maskParams      stringList
+	scrub           RegexpList
+	anonIp          string
+	hashUsers       bool
+	hashSalt        string
+	enrich          stringList
+	podInfo         string
+	sink            string
+	deterministic   bool
+	config          string
+}
+
+func (opts *options) register(flags *flag.FlagSet) {
+	flags.StringVar(&opts.config, "config", "", "YAML configuration file. Options on the command line override it. Reloaded on SIGHUP")
+	flags.StringVar(&opts.ikey, "ikey", "", "ApplicationInsights instrumentation key (required unless -connection-string is used)")
+	flags.StringVar(&opts.connString, "connection-string", "", "ApplicationInsights connection string, in place of -ikey and -endpoint")
+	flags.StringVar(&opts.endpoint, "endpoint", "", "ApplicationInsights ingestion endpoint")
+	flags.StringVar(&opts.sink, "sink", "", "Write telemetry as JSON to 'stdout' or 'file:path' instead of sending it")
+	flags.BoolVar(&opts.deterministic, "deterministic", false, "With -sink, number generated IDs in order and leave out tags that come from the machine, so nginx logs with timestamps give the same output each run")
+	flags.StringVar(&opts.role, "role", "", "Telemetry role name. Defaults to the machine hostname")
+	flags.StringVar(&opts.roleInstance, "roleinstance", "", "Telemetry role instance. Defaults to the machine hostname")
+	flags.StringVar(&opts.infile, "in", "", "Input file, '-' for stdin, or 'http:host:port' for handlers that receive HTTP requests (required)")
+	flags.StringVar(&opts.outfile, "out", "", "Output file, '-' for stdout, 'stderr' for stderr")
+	opts.output.register(flags)
+	opts.mirror.register(flags)
+	flags.StringVar(&opts.deadLetter, "deadletter", "", "Output file for lines that couldn't be processed, with the reason")
+	flags.BoolVar(&opts.forwardRejected, "forwardrejected", false, "Send lines that couldn't be processed as traces")
+	flags.DurationVar(&opts.flushWait, "flush", 3*time.Second, "Timeout to flush telemetry when shutting down")
+	flags.DurationVar(&opts.errorSummary, "errorsummary", time.Minute, "Interval between summaries of lines that couldn't be processed, or 0 to report each one")
+	flags.IntVar(&opts.maxLine, "maxline", defaultMaxLineLength, "Longest line to read in bytes, or 0 for no limit")
+	flags.Var(&opts.longLines, "longlines", "What to do with lines longer than -maxline: truncate (default) or split")
+	flags.DurationVar(&opts.idleFlush, "idleflush", 0, "Send a partial line after waiting this long for the rest of it, or 0 to wait until the input closes")
+	flags.IntVar(&opts.workers, "workers", 1, "Number of goroutines per input that parse lines concurrently, for handlers that support it")
+	flags.BoolVar(&opts.debug, "debug", false, "Show debugging output")
+	flags.BoolVar(&opts.quiet, "quiet", false, "Don't write any output messages")
+	flags.Var(&opts.custom, "custom", "Include custom property in telemetry like 'key=value'. Can be used multiple times")
+	flags.Float64Var(&opts.sampling, "sampling", 0, "Send only this percentage of telemetry, e.g. 25")
+	flags.Float64Var(&opts.adaptive, "adaptive", 0, "Adaptively sample telemetry to send about this many items per second")
+	flags.Var(&opts.maskParams, "maskparam", "Mask the value of this query string parameter in URLs, properties and messages. Can be used multiple times")
+	flags.Var(&opts.scrub, "scrub", "Replace text that matches this regex in URLs, properties and messages. Can be used multiple times")
+	flags.StringVar(&opts.anonIp, "anonip", "", "Anonymize client IP addresses: truncate, hash, drop")
+	flags.BoolVar(&opts.hashUsers, "hashusers", false, "Send hashes of user IDs instead of the IDs themselves")
+	flags.StringVar(&opts.hashSalt, "hashsalt", "", "Salt for hashed IP addresses and user IDs")
+	flags.Var(&opts.enrich, "enrich", "Add properties to telemetry: kubernetes, container, process, version, iptype. Can be used multiple times")
+	flags.StringVar(&opts.podInfo, "podinfo", defaultPodInfo, "Directory of Kubernetes downward API files for -enrich kubernetes")
+}
+
+// resolveEndpoint fills in the instrumentation key and endpoint from the
+// connection string.  Explicit -ikey and -endpoint take precedence.  The
+// instrumentation key isn't needed if telemetry goes to a sink, which is the
+// only place -deterministic is useful.
+func (opts *options) resolveEndpoint() error {
+	if opts.connString != "" {
+		ikey, endpoint, err := parseConnectionString(opts.connString)
+		if err != nil {
+			return fmt.Errorf("Error parsing connection string: %s", err.Error())
+		}
+
+		if opts.ikey == "" {
+			opts.ikey = ikey
+		}
+
+		if opts.endpoint == "" {
+			opts.endpoint = endpoint
+		}
+	}
+
+	if opts.ikey == "" && opts.sink == "" {
+		return fmt.Errorf("Must specify instrumentation key or connection string. See -help for usage.")
+	}
+
+	if opts.deterministic && opts.sink == "" {
+		return fmt.Errorf("-deterministic requires -sink")
+	}
+
+	return nil
+}
+
+// lineLimits returns the limits for reading lines from inputs.
+func (opts *options) lineLimits() LineLimits {
+	return LineLimits{
+		MaxLength: opts.maxLine,
+		Split:     bool(opts.longLines),
+		IdleFlush: opts.idleFlush,
+	}
+}
@@ -0,0 +1,351 @@
+package common
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common/otlpmodel"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Severity numbers of Application Insights severity levels
+var otlpSeverities = map[contracts.SeverityLevel]int{
+	contracts.Verbose:     5,
+	contracts.Information: 9,
+	contracts.Warning:     13,
+	contracts.Error:       17,
+	contracts.Critical:    21,
+}
+
+// otlpExporter sends requests and dependencies to an OTLP/HTTP endpoint as
+// spans, and traces, events and exceptions as log records.  Other telemetry
+// is skipped.
+type otlpExporter struct {
+	tracesUrl string
+	logsUrl   string
+	client    *http.Client
+}
+
+func newOtlpExporter(endpoint string) *otlpExporter {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	return &otlpExporter{
+		tracesUrl: endpoint + "/v1/traces",
+		logsUrl:   endpoint + "/v1/logs",
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (exp *otlpExporter) export(batch []*contracts.Envelope) ([]*contracts.Envelope, error) {
+	var spans, logs []*contracts.Envelope
+	traces := &otlpmodel.ExportRequest{}
+	records := &otlpmodel.ExportRequest{}
+	for _, envelope := range batch {
+		if span := otlpSpanOf(envelope); span != nil {
+			spans = append(spans, envelope)
+			scope := otlpScopeSpans(traces, envelope)
+			scope.Spans = append(scope.Spans, span)
+		} else if record := otlpLogRecordOf(envelope); record != nil {
+			logs = append(logs, envelope)
+			scope := otlpScopeLogs(records, envelope)
+			scope.LogRecords = append(scope.LogRecords, record)
+		}
+	}
+
+	// Spans aren't sent again if only the logs fail
+	if len(spans) > 0 {
+		if err := exp.post(exp.tracesUrl, traces); err != nil {
+			return append(spans, logs...), err
+		}
+	}
+
+	if len(logs) > 0 {
+		if err := exp.post(exp.logsUrl, records); err != nil {
+			return logs, err
+		}
+	}
+
+	return nil, nil
+}
+
+func (exp *otlpExporter) post(url string, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	return postJSON(exp.client, url, body)
+}
+
+func (exp *otlpExporter) close() {
+}
+
+// otlpScopeSpans returns the spans for the envelope's role and role
+// instance.
+func otlpScopeSpans(request *otlpmodel.ExportRequest, envelope *contracts.Envelope) *otlpmodel.ScopeSpans {
+	resource := otlpResourceOf(envelope)
+	for _, spans := range request.ResourceSpans {
+		if sameResource(&spans.Resource, &resource) {
+			return spans.ScopeSpans[0]
+		}
+	}
+
+	spans := &otlpmodel.ResourceSpans{Resource: resource, ScopeSpans: []*otlpmodel.ScopeSpans{{Scope: otlpForwarderScope()}}}
+	request.ResourceSpans = append(request.ResourceSpans, spans)
+	return spans.ScopeSpans[0]
+}
+
+// otlpScopeLogs returns the log records for the envelope's role and role
+// instance.
+func otlpScopeLogs(request *otlpmodel.ExportRequest, envelope *contracts.Envelope) *otlpmodel.ScopeLogs {
+	resource := otlpResourceOf(envelope)
+	for _, logs := range request.ResourceLogs {
+		if sameResource(&logs.Resource, &resource) {
+			return logs.ScopeLogs[0]
+		}
+	}
+
+	logs := &otlpmodel.ResourceLogs{Resource: resource, ScopeLogs: []*otlpmodel.ScopeLogs{{Scope: otlpForwarderScope()}}}
+	request.ResourceLogs = append(request.ResourceLogs, logs)
+	return logs.ScopeLogs[0]
+}
+
+func otlpForwarderScope() otlpmodel.Scope {
+	return otlpmodel.Scope{Name: "ApplicationInsights-logforward", Version: Version}
+}
+
+// otlpResourceOf describes the role and role instance as a resource.
+func otlpResourceOf(envelope *contracts.Envelope) otlpmodel.Resource {
+	var result otlpmodel.Resource
+	if role := envelope.Tags[contracts.CloudRole]; role != "" {
+		result.Attributes = append(result.Attributes, otlpmodel.StringAttribute("service.name", role))
+	}
+
+	if instance := envelope.Tags[contracts.CloudRoleInstance]; instance != "" {
+		result.Attributes = append(result.Attributes, otlpmodel.StringAttribute("service.instance.id", instance))
+	}
+
+	return result
+}
+
+func sameResource(a, b *otlpmodel.Resource) bool {
+	if len(a.Attributes) != len(b.Attributes) {
+		return false
+	}
+
+	for i := range a.Attributes {
+		if a.Attributes[i].Key != b.Attributes[i].Key || *a.Attributes[i].Value.StringValue != *b.Attributes[i].Value.StringValue {
+			return false
+		}
+	}
+
+	return true
+}
+
+// otlpSpanOf converts a request or dependency to a span, or returns nil for
+// other telemetry.
+func otlpSpanOf(envelope *contracts.Envelope) *otlpmodel.Span {
+	data, ok := envelope.Data.(*contracts.Data)
+	if !ok {
+		return nil
+	}
+
+	var span *otlpmodel.Span
+	var duration string
+	switch item := data.BaseData.(type) {
+	case *contracts.RequestData:
+		span = &otlpmodel.Span{
+			SpanId:     otlpId(item.Id, 8),
+			Name:       item.Name,
+			Kind:       otlpmodel.SpanKindServer,
+			Attributes: otlpAttributes(item.Properties, item.Measurements),
+			Status:     otlpStatusOf(item.Success),
+		}
+
+		if item.Url != "" {
+			span.Attributes = append(span.Attributes, otlpmodel.StringAttribute("url.full", item.Url))
+		}
+
+		span.Attributes = append(span.Attributes, otlpResultCode("http.response.status_code", item.ResponseCode))
+		duration = item.Duration
+	case *contracts.RemoteDependencyData:
+		span = &otlpmodel.Span{
+			SpanId:     otlpId(item.Id, 8),
+			Name:       item.Name,
+			Kind:       otlpmodel.SpanKindClient,
+			Attributes: otlpAttributes(item.Properties, item.Measurements),
+			Status:     otlpStatusOf(item.Success),
+		}
+
+		for _, kv := range [][2]string{{"dependency.type", item.Type}, {"dependency.target", item.Target}, {"dependency.data", item.Data}} {
+			if kv[1] != "" {
+				span.Attributes = append(span.Attributes, otlpmodel.StringAttribute(kv[0], kv[1]))
+			}
+		}
+
+		span.Attributes = append(span.Attributes, otlpResultCode("dependency.result_code", item.ResultCode))
+		duration = item.Duration
+	default:
+		return nil
+	}
+
+	span.TraceId = otlpId(envelope.Tags[contracts.OperationId], 16)
+	if parent := envelope.Tags[contracts.OperationParentId]; parent != "" && parent != envelope.Tags[contracts.OperationId] {
+		span.ParentSpanId = otlpId(parent, 8)
+	}
+
+	start := otlpTime(envelope.Time)
+	span.StartTimeUnixNano = otlpmodel.Uint64(start.UnixNano())
+	span.EndTimeUnixNano = otlpmodel.Uint64(start.Add(parseAIDuration(duration)).UnixNano())
+	span.Attributes = append(span.Attributes, otlpTagAttributes(envelope.Tags)...)
+	return span
+}
+
+// otlpLogRecordOf converts a trace, event or exception to a log record, or
+// returns nil for other telemetry.
+func otlpLogRecordOf(envelope *contracts.Envelope) *otlpmodel.LogRecord {
+	data, ok := envelope.Data.(*contracts.Data)
+	if !ok {
+		return nil
+	}
+
+	record := &otlpmodel.LogRecord{}
+	var body string
+	switch item := data.BaseData.(type) {
+	case *contracts.MessageData:
+		body = item.Message
+		record.SeverityNumber = otlpSeverities[item.SeverityLevel]
+		record.SeverityText = item.SeverityLevel.String()
+		record.Attributes = otlpAttributes(item.Properties, nil)
+	case *contracts.EventData:
+		body = item.Name
+		record.Attributes = append(otlpAttributes(item.Properties, item.Measurements), otlpmodel.StringAttribute("event.name", item.Name))
+	case *contracts.ExceptionData:
+		record.SeverityNumber = otlpSeverities[item.SeverityLevel]
+		record.SeverityText = item.SeverityLevel.String()
+		record.Attributes = otlpAttributes(item.Properties, item.Measurements)
+		if len(item.Exceptions) > 0 {
+			body = item.Exceptions[0].Message
+			record.Attributes = append(record.Attributes,
+				otlpmodel.StringAttribute("exception.type", item.Exceptions[0].TypeName),
+				otlpmodel.StringAttribute("exception.message", item.Exceptions[0].Message))
+		}
+	default:
+		return nil
+	}
+
+	record.Body = otlpmodel.AnyValue{StringValue: &body}
+	record.TimeUnixNano = otlpmodel.Uint64(otlpTime(envelope.Time).UnixNano())
+	record.TraceId = otlpId(envelope.Tags[contracts.OperationId], 16)
+	if parent := envelope.Tags[contracts.OperationParentId]; parent != "" && parent != envelope.Tags[contracts.OperationId] {
+		record.SpanId = otlpId(parent, 8)
+	}
+
+	record.Attributes = append(record.Attributes, otlpTagAttributes(envelope.Tags)...)
+	return record
+}
+
+func otlpAttributes(properties map[string]string, measurements map[string]float64) []*otlpmodel.KeyValue {
+	var result []*otlpmodel.KeyValue
+	for k, v := range properties {
+		result = append(result, otlpmodel.StringAttribute(k, v))
+	}
+
+	for k, v := range measurements {
+		result = append(result, otlpmodel.DoubleAttribute(k, v))
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+
+	return result
+}
+
+// Context tags that have an OpenTelemetry attribute
+var otlpTagNames = [][2]string{
+	{contracts.LocationIp, "client.address"},
+	{contracts.UserId, "enduser.id"},
+	{contracts.SessionId, "session.id"},
+}
+
+func otlpTagAttributes(tags map[string]string) []*otlpmodel.KeyValue {
+	var result []*otlpmodel.KeyValue
+	for _, names := range otlpTagNames {
+		if value := tags[names[0]]; value != "" {
+			result = append(result, otlpmodel.StringAttribute(names[1], value))
+		}
+	}
+
+	return result
+}
+
+// otlpResultCode is an integer attribute if the code is a number.
+func otlpResultCode(key, code string) *otlpmodel.KeyValue {
+	if value, err := strconv.ParseInt(code, 10, 64); err == nil {
+		return otlpmodel.IntAttribute(key, value)
+	}
+
+	return otlpmodel.StringAttribute(key, code)
+}
+
+func otlpStatusOf(success bool) otlpmodel.Status {
+	if success {
+		return otlpmodel.Status{Code: otlpmodel.StatusOk}
+	}
+
+	return otlpmodel.Status{Code: otlpmodel.StatusError}
+}
+
+// otlpId returns a hex ID of the given number of bytes.  Application
+// Insights IDs that already are one, or end with one like "|trace.span.",
+// are used as-is; others are hashed.
+func otlpId(id string, size int) string {
+	candidate := strings.ToLower(id)
+	if fields := strings.FieldsFunc(candidate, func(r rune) bool { return r == '|' || r == '.' }); len(fields) > 0 {
+		candidate = fields[len(fields)-1]
+	}
+
+	if _, err := hex.DecodeString(candidate); err == nil && len(candidate) == size*2 {
+		return candidate
+	}
+
+	sum := md5.Sum([]byte(id))
+	return hex.EncodeToString(sum[:size])
+}
+
+func otlpTime(timestamp string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		return t
+	}
+
+	return time.Now()
+}
+
+// parseAIDuration parses a duration in the "d.hh:mm:ss.fffffff" format of
+// Application Insights telemetry, or returns 0 if it's invalid.
+func parseAIDuration(duration string) time.Duration {
+	var days int64
+	if i := strings.Index(duration, "."); i >= 0 && i < strings.Index(duration, ":") {
+		days, _ = strconv.ParseInt(duration[:i], 10, 64)
+		duration = duration[i+1:]
+	}
+
+	parts := strings.Split(duration, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+
+	hours, err1 := strconv.ParseInt(parts[0], 10, 64)
+	minutes, err2 := strconv.ParseInt(parts[1], 10, 64)
+	seconds, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0
+	}
+
+	return time.Duration(days)*24*time.Hour + time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+}
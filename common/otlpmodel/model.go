@@ -0,0 +1,242 @@
+// Package otlpmodel holds the parts of OpenTelemetry's OTLP export requests
+// that map to Application Insights telemetry.  The types are encoded and
+// decoded as OTLP/HTTP JSON by encoding/json, and decoded from protobuf by
+// DecodeTraces and DecodeLogs.  Trace and span IDs are kept as hex, like in
+// JSON.
+package otlpmodel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExportRequest is an ExportTraceServiceRequest or an
+// ExportLogsServiceRequest.
+type ExportRequest struct {
+	ResourceSpans []*ResourceSpans `json:"resourceSpans,omitempty"`
+	ResourceLogs  []*ResourceLogs  `json:"resourceLogs,omitempty"`
+}
+
+type ResourceSpans struct {
+	Resource   Resource      `json:"resource"`
+	ScopeSpans []*ScopeSpans `json:"scopeSpans"`
+}
+
+type ScopeSpans struct {
+	Scope Scope   `json:"scope"`
+	Spans []*Span `json:"spans"`
+}
+
+type Span struct {
+	TraceId           string      `json:"traceId"`
+	SpanId            string      `json:"spanId"`
+	ParentSpanId      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano Uint64      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   Uint64      `json:"endTimeUnixNano"`
+	Attributes        []*KeyValue `json:"attributes,omitempty"`
+	Status            Status      `json:"status"`
+}
+
+// Span kinds
+const (
+	SpanKindUnspecified = iota
+	SpanKindInternal
+	SpanKindServer
+	SpanKindClient
+	SpanKindProducer
+	SpanKindConsumer
+)
+
+type Status struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// Status codes
+const (
+	StatusUnset = iota
+	StatusOk
+	StatusError
+)
+
+type ResourceLogs struct {
+	Resource  Resource     `json:"resource"`
+	ScopeLogs []*ScopeLogs `json:"scopeLogs"`
+}
+
+type ScopeLogs struct {
+	Scope      Scope        `json:"scope"`
+	LogRecords []*LogRecord `json:"logRecords"`
+}
+
+type LogRecord struct {
+	TimeUnixNano         Uint64      `json:"timeUnixNano"`
+	ObservedTimeUnixNano Uint64      `json:"observedTimeUnixNano,omitempty"`
+	SeverityNumber       int         `json:"severityNumber,omitempty"`
+	SeverityText         string      `json:"severityText,omitempty"`
+	Body                 AnyValue    `json:"body"`
+	Attributes           []*KeyValue `json:"attributes,omitempty"`
+	TraceId              string      `json:"traceId,omitempty"`
+	SpanId               string      `json:"spanId,omitempty"`
+}
+
+type Resource struct {
+	Attributes []*KeyValue `json:"attributes,omitempty"`
+}
+
+// Scope is the instrumentation scope that produced the spans or logs.
+type Scope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue holds one of its fields, or none for an empty value.
+type AnyValue struct {
+	StringValue *string      `json:"stringValue,omitempty"`
+	BoolValue   *bool        `json:"boolValue,omitempty"`
+	IntValue    *Int64       `json:"intValue,omitempty"`
+	DoubleValue *float64     `json:"doubleValue,omitempty"`
+	ArrayValue  *ArrayValue  `json:"arrayValue,omitempty"`
+	KvlistValue *KvlistValue `json:"kvlistValue,omitempty"`
+	BytesValue  []byte       `json:"bytesValue,omitempty"`
+}
+
+type ArrayValue struct {
+	Values []*AnyValue `json:"values"`
+}
+
+type KvlistValue struct {
+	Values []*KeyValue `json:"values"`
+}
+
+// StringAttribute returns a key/value pair with a string value.
+func StringAttribute(key, value string) *KeyValue {
+	return &KeyValue{Key: key, Value: AnyValue{StringValue: &value}}
+}
+
+// IntAttribute returns a key/value pair with an integer value.
+func IntAttribute(key string, value int64) *KeyValue {
+	i := Int64(value)
+	return &KeyValue{Key: key, Value: AnyValue{IntValue: &i}}
+}
+
+// DoubleAttribute returns a key/value pair with a floating point value.
+func DoubleAttribute(key string, value float64) *KeyValue {
+	return &KeyValue{Key: key, Value: AnyValue{DoubleValue: &value}}
+}
+
+// String formats the value for a property or a message.  Arrays and lists
+// of key/value pairs are formatted as JSON, and bytes as base64.
+func (v *AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.ArrayValue != nil, v.KvlistValue != nil:
+		data, _ := json.Marshal(v.plain())
+		return string(data)
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+
+	if plain := v.plain(); plain != nil {
+		return fmt.Sprint(plain)
+	}
+
+	return ""
+}
+
+// plain returns the value as the corresponding Go type.
+func (v *AnyValue) plain() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		result := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, item := range v.ArrayValue.Values {
+			if item == nil {
+				result = append(result, nil)
+			} else {
+				result = append(result, item.plain())
+			}
+		}
+
+		return result
+	case v.KvlistValue != nil:
+		result := make(map[string]interface{})
+		for _, kv := range v.KvlistValue.Values {
+			if kv != nil {
+				result[kv.Key] = kv.Value.plain()
+			}
+		}
+
+		return result
+	case v.BytesValue != nil:
+		return v.BytesValue
+	}
+
+	return nil
+}
+
+// AttributeMap returns the attributes as strings, by key.  Null
+// attributes are skipped.
+func AttributeMap(attributes []*KeyValue) map[string]string {
+	result := make(map[string]string)
+	for _, kv := range attributes {
+		if kv != nil {
+			result[kv.Key] = kv.Value.String()
+		}
+	}
+
+	return result
+}
+
+// Int64 is a 64-bit integer, which JSON encodes as a string, although
+// numbers are accepted too.
+type Int64 int64
+
+func (i Int64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+func (i *Int64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid integer %s", data)
+	}
+
+	*i = Int64(value)
+	return nil
+}
+
+// Uint64 is an unsigned 64-bit integer, like Int64.
+type Uint64 uint64
+
+func (i Uint64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(i), 10))
+}
+
+func (i *Uint64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid integer %s", data)
+	}
+
+	*i = Uint64(value)
+	return nil
+}
@@ -0,0 +1,80 @@
+package otlpmodel
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	request := &ExportRequest{ResourceSpans: []*ResourceSpans{{
+		ScopeSpans: []*ScopeSpans{{
+			Scope: Scope{Name: "test"},
+			Spans: []*Span{{
+				Name:              "span",
+				Kind:              SpanKindServer,
+				StartTimeUnixNano: 1 << 62,
+				Attributes:        []*KeyValue{IntAttribute("int", -5), StringAttribute("string", "value")},
+			}},
+		}},
+	}}}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err.Error())
+	}
+
+	// 64-bit integers are strings, and the other signal is left out
+	text := string(data)
+	if !strings.Contains(text, `"startTimeUnixNano":"4611686018427387904"`) || !strings.Contains(text, `"intValue":"-5"`) || strings.Contains(text, "resourceLogs") {
+		t.Errorf("Unexpected JSON: %s", text)
+	}
+
+	decoded := &ExportRequest{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err.Error())
+	}
+
+	s := decoded.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if s.StartTimeUnixNano != 1<<62 || s.Kind != SpanKindServer || decoded.ResourceSpans[0].ScopeSpans[0].Scope.Name != "test" {
+		t.Errorf("Unexpected span: %+v", s)
+	}
+
+	if attributes := AttributeMap(s.Attributes); attributes["int"] != "-5" || attributes["string"] != "value" {
+		t.Errorf("Unexpected attributes: %v", attributes)
+	}
+}
+
+func TestUnmarshalNumbers(t *testing.T) {
+	var record LogRecord
+	if err := json.Unmarshal([]byte(`{"timeUnixNano":18446744073709551615,"body":{"intValue":7}}`), &record); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err.Error())
+	}
+
+	if record.TimeUnixNano != 1<<64-1 || record.Body.String() != "7" {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	if err := json.Unmarshal([]byte(`{"timeUnixNano":"-1"}`), &record); err == nil {
+		t.Error("Expected an error for a negative time")
+	}
+}
+
+func TestDecodeScope(t *testing.T) {
+	// ExportLogsServiceRequest { ResourceLogs { ScopeLogs { Scope { name, version }, LogRecord {} } } }
+	scope := []byte{0x0a, 0x01, 'n', 0x12, 0x01, 'v'}
+	scopeLogs := append([]byte{0x0a, byte(len(scope))}, scope...)
+	scopeLogs = append(scopeLogs, 0x12, 0x00)
+	resourceLogs := append([]byte{0x12, byte(len(scopeLogs))}, scopeLogs...)
+	data := append([]byte{0x0a, byte(len(resourceLogs))}, resourceLogs...)
+
+	request, err := DecodeLogs(data)
+	if err != nil {
+		t.Fatalf("DecodeLogs failed: %s", err.Error())
+	}
+
+	sl := request.ResourceLogs[0].ScopeLogs[0]
+	if sl.Scope.Name != "n" || sl.Scope.Version != "v" || len(sl.LogRecords) != 1 {
+		t.Errorf("Unexpected scope logs: %+v", sl)
+	}
+}
@@ -0,0 +1,344 @@
+package otlpmodel
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+)
+
+// Deepest nesting of messages accepted.  Attribute values can nest
+// without limit, and each level is decoded recursively.
+const maxProtoDepth = 64
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoField is a field read from a protobuf message.  Numeric values are
+// in bits, and length-delimited ones, like strings and nested messages, in
+// data.  depth is how deeply the message containing it is nested.
+type protoField struct {
+	number   int
+	wireType int
+	bits     uint64
+	data     []byte
+	depth    int
+}
+
+var errTruncated = fmt.Errorf("Invalid protobuf: message is truncated")
+
+// parseProto calls fn for each field in a protobuf message, in order.  The
+// wire format is simple enough, and the OTLP messages small enough, that a
+// generated decoder isn't worth the dependency.
+func parseProto(data []byte, depth int, fn func(field *protoField) error) error {
+	if depth > maxProtoDepth {
+		return fmt.Errorf("Invalid protobuf: messages are nested more than %d deep", maxProtoDepth)
+	}
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+
+		data = data[n:]
+		field := &protoField{number: int(key >> 3), wireType: int(key & 7), depth: depth}
+		switch field.wireType {
+		case wireVarint:
+			if field.bits, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+
+			field.bits = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+
+			field.bits = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errTruncated
+			}
+
+			field.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return fmt.Errorf("Invalid protobuf: unsupported wire type %d", field.wireType)
+		}
+
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// check returns an error unless the field has the wire type.
+func (field *protoField) check(wireType int) error {
+	if field.wireType != wireType {
+		return fmt.Errorf("Invalid protobuf: field %d has wire type %d, expected %d", field.number, field.wireType, wireType)
+	}
+
+	return nil
+}
+
+func (field *protoField) string() (string, error) {
+	return string(field.data), field.check(wireBytes)
+}
+
+// id returns a trace or span ID as hex.
+func (field *protoField) id() (string, error) {
+	return hex.EncodeToString(field.data), field.check(wireBytes)
+}
+
+func (field *protoField) int() (int, error) {
+	return int(int32(field.bits)), field.check(wireVarint)
+}
+
+func (field *protoField) fixed64() (Uint64, error) {
+	return Uint64(field.bits), field.check(wireFixed64)
+}
+
+// message parses the field as a nested message.
+func (field *protoField) message(fn func(field *protoField) error) error {
+	if err := field.check(wireBytes); err != nil {
+		return err
+	}
+
+	return parseProto(field.data, field.depth+1, fn)
+}
+
+// DecodeTraces decodes an ExportTraceServiceRequest.
+func DecodeTraces(data []byte) (*ExportRequest, error) {
+	result := &ExportRequest{}
+	err := parseProto(data, 0, func(field *protoField) error {
+		if field.number != 1 {
+			return nil
+		}
+
+		rs := &ResourceSpans{}
+		result.ResourceSpans = append(result.ResourceSpans, rs)
+		return field.message(func(field *protoField) error {
+			switch field.number {
+			case 1:
+				return field.message(rs.Resource.decode)
+			case 2:
+				ss := &ScopeSpans{}
+				rs.ScopeSpans = append(rs.ScopeSpans, ss)
+				return field.message(func(field *protoField) error {
+					switch field.number {
+					case 1:
+						return field.message(ss.Scope.decode)
+					case 2:
+						s := &Span{}
+						ss.Spans = append(ss.Spans, s)
+						return field.message(s.decode)
+					}
+
+					return nil
+				})
+			}
+
+			return nil
+		})
+	})
+
+	return result, err
+}
+
+// DecodeLogs decodes an ExportLogsServiceRequest.
+func DecodeLogs(data []byte) (*ExportRequest, error) {
+	result := &ExportRequest{}
+	err := parseProto(data, 0, func(field *protoField) error {
+		if field.number != 1 {
+			return nil
+		}
+
+		rl := &ResourceLogs{}
+		result.ResourceLogs = append(result.ResourceLogs, rl)
+		return field.message(func(field *protoField) error {
+			switch field.number {
+			case 1:
+				return field.message(rl.Resource.decode)
+			case 2:
+				sl := &ScopeLogs{}
+				rl.ScopeLogs = append(rl.ScopeLogs, sl)
+				return field.message(func(field *protoField) error {
+					switch field.number {
+					case 1:
+						return field.message(sl.Scope.decode)
+					case 2:
+						record := &LogRecord{}
+						sl.LogRecords = append(sl.LogRecords, record)
+						return field.message(record.decode)
+					}
+
+					return nil
+				})
+			}
+
+			return nil
+		})
+	})
+
+	return result, err
+}
+
+func (s *Span) decode(field *protoField) error {
+	var err error
+	switch field.number {
+	case 1:
+		s.TraceId, err = field.id()
+	case 2:
+		s.SpanId, err = field.id()
+	case 4:
+		s.ParentSpanId, err = field.id()
+	case 5:
+		s.Name, err = field.string()
+	case 6:
+		s.Kind, err = field.int()
+	case 7:
+		s.StartTimeUnixNano, err = field.fixed64()
+	case 8:
+		s.EndTimeUnixNano, err = field.fixed64()
+	case 9:
+		err = decodeAttribute(field, &s.Attributes)
+	case 15:
+		err = field.message(func(field *protoField) error {
+			var err error
+			switch field.number {
+			case 2:
+				s.Status.Message, err = field.string()
+			case 3:
+				s.Status.Code, err = field.int()
+			}
+
+			return err
+		})
+	}
+
+	return err
+}
+
+func (record *LogRecord) decode(field *protoField) error {
+	var err error
+	switch field.number {
+	case 1:
+		record.TimeUnixNano, err = field.fixed64()
+	case 2:
+		record.SeverityNumber, err = field.int()
+	case 3:
+		record.SeverityText, err = field.string()
+	case 5:
+		err = field.message(record.Body.decode)
+	case 6:
+		err = decodeAttribute(field, &record.Attributes)
+	case 9:
+		record.TraceId, err = field.id()
+	case 10:
+		record.SpanId, err = field.id()
+	case 11:
+		record.ObservedTimeUnixNano, err = field.fixed64()
+	}
+
+	return err
+}
+
+func (r *Resource) decode(field *protoField) error {
+	if field.number == 1 {
+		return decodeAttribute(field, &r.Attributes)
+	}
+
+	return nil
+}
+
+func (scope *Scope) decode(field *protoField) error {
+	var err error
+	switch field.number {
+	case 1:
+		scope.Name, err = field.string()
+	case 2:
+		scope.Version, err = field.string()
+	}
+
+	return err
+}
+
+// decodeAttribute decodes a KeyValue and adds it to attributes.
+func decodeAttribute(field *protoField, attributes *[]*KeyValue) error {
+	kv := &KeyValue{}
+	*attributes = append(*attributes, kv)
+	return field.message(func(field *protoField) error {
+		var err error
+		switch field.number {
+		case 1:
+			kv.Key, err = field.string()
+		case 2:
+			err = field.message(kv.Value.decode)
+		}
+
+		return err
+	})
+}
+
+func (v *AnyValue) decode(field *protoField) error {
+	switch field.number {
+	case 1:
+		value, err := field.string()
+		v.StringValue = &value
+		return err
+	case 2:
+		value := field.bits != 0
+		v.BoolValue = &value
+		return field.check(wireVarint)
+	case 3:
+		value := Int64(field.bits)
+		v.IntValue = &value
+		return field.check(wireVarint)
+	case 4:
+		value := math.Float64frombits(field.bits)
+		v.DoubleValue = &value
+		return field.check(wireFixed64)
+	case 5:
+		v.ArrayValue = &ArrayValue{}
+		return field.message(func(field *protoField) error {
+			if field.number != 1 {
+				return nil
+			}
+
+			item := &AnyValue{}
+			v.ArrayValue.Values = append(v.ArrayValue.Values, item)
+			return field.message(item.decode)
+		})
+	case 6:
+		v.KvlistValue = &KvlistValue{}
+		return field.message(func(field *protoField) error {
+			if field.number == 1 {
+				return decodeAttribute(field, &v.KvlistValue.Values)
+			}
+
+			return nil
+		})
+	case 7:
+		v.BytesValue = append([]byte{}, field.data...)
+		return field.check(wireBytes)
+	}
+
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
+	"sync"
 )
 
 type unescapeCallback func(string, *bytes.Buffer) bool
@@ -15,17 +17,60 @@ type ParserOptions struct {
 	EscapeRegex    string
 	Unescape       unescapeCallback
 	UnwrapVariable unwrapCallback
+
+	// legacy selects how lines were searched before the parser was sped up:
+	// the escape regexp runs over every line, and separators are found with
+	// Boyer-Moore.  It's only for benchmarks to compare against.
+	legacy bool
 }
 
 type Parser struct {
 	escapeRE         *regexp.Regexp
+	escapeAtRE       *regexp.Regexp
+	escapePrefix     string
 	segments         []*parserSegment
 	unescapeCallback unescapeCallback
+	variables        int
+	results          sync.Pool
+}
+
+// Kinds of values that a typed variable accepts.  Untyped variables are
+// strings that extend up to the next separator.
+type valueType int
+
+const (
+	stringValue valueType = iota
+	quotedValue
+	intValue
+	floatValue
+	tokenValue
+)
+
+// Type names, as used in formats
+var valueTypeNames = []string{"string", "quoted", "int", "float", "token"}
+
+func (kind valueType) String() string {
+	return valueTypeNames[kind]
 }
 
 type parserSegment struct {
 	variable string
-	searcher *stringSearcher
+	kind     valueType
+
+	// Separator as written in the format, and a searcher for each of its
+	// alternatives
+	separator string
+	searchers []*stringSearcher
+
+	// Whether there is an optional marker in or right before the separator.
+	// If so, required searches for the part of the separator before the
+	// marker, if there is one.
+	optional bool
+	required *stringSearcher
+
+	// Whether the segment must reach the end of the line, which is the case
+	// for a typed variable at the end of the format
+	last bool
 }
 
 type ParserResultStorage interface {
@@ -34,6 +79,75 @@ type ParserResultStorage interface {
 
 var NO_MATCH error = errors.New("Match not found")
 
+// Format syntax that doesn't depend on ParserOptions: typed variables like
+// ${name:int} and optional markers.
+var formatSyntaxRE = regexp.MustCompile(`\$\{([A-Za-z0-9_]+):([a-z]+)\}|\$\?`)
+
+const (
+	optionalMarker    = "$?"
+	alternativeMarker = "$|"
+)
+
+// ParseError describes where a line stopped matching the format.
+type ParseError struct {
+	// Index of the format segment (a variable and the separator after it)
+	// that failed to match
+	Segment int
+
+	// Name of the variable being read, if any
+	Variable string
+
+	// Type of the variable, if it is typed
+	Type string
+
+	// Separator that was expected after the variable
+	Separator string
+
+	// Byte offset in the line where matching failed: where a typed value
+	// or the separator was expected, or after the longest partial match of
+	// the separator
+	Offset int
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("%s at byte %d, %s", NO_MATCH.Error(), err.Offset, err.Position())
+}
+
+// Position describes the part of the format that failed to match, without
+// reference to a particular line.
+func (err *ParseError) Position() string {
+	expected := fmt.Sprintf("%q", err.Separator)
+	if err.Type != "" {
+		expected = err.Type + " value"
+		if err.Separator != "" {
+			expected += fmt.Sprintf(" followed by %q", err.Separator)
+		}
+	}
+
+	if err.Variable != "" {
+		return fmt.Sprintf("segment %d (%s): expected %s", err.Segment, err.Variable, expected)
+	}
+
+	return fmt.Sprintf("segment %d: expected %s", err.Segment, expected)
+}
+
+// Unwrap allows ParseError to match NO_MATCH with errors.Is.
+func (err *ParseError) Unwrap() error {
+	return NO_MATCH
+}
+
+// NewParser compiles a format.  Besides variables that match
+// options.VariableRegex, the format may contain:
+//
+//   - Typed variables like ${name:int}, which only match values of their
+//     type: quoted (a quoted string or '-'), int, float, token (anything up
+//     to whitespace) or string.  Other than strings, they don't need a
+//     separator to find their end, so they can be followed directly by
+//     another variable.  At the end of the format, they must match the rest
+//     of the line.
+//   - Alternative separators like ' $|\t', any one of which may appear.
+//   - Optional markers, '$?', after which the rest of the format may be
+//     missing from the line.
 func NewParser(format string, options *ParserOptions) (*Parser, error) {
 	// Compile variable regexp
 	varRE, err := regexp.Compile(options.VariableRegex)
@@ -46,59 +160,209 @@ func NewParser(format string, options *ParserOptions) (*Parser, error) {
 		return nil, err
 	}
 
-	// Split format into variables/separator
-	segments := splitSegments(format, varRE)
+	// Split format into variables/separator/markers
+	tokens, err := tokenizeFormat(format, varRE, options.UnwrapVariable)
+	if err != nil {
+		return nil, err
+	}
 
 	// Combine var-sep-var-sep-... sequence into []*parserSegment
-	// We'll compile (Boyer-Moore) the separators and cache those results since they're
+	// We'll compile the separators and cache those results since they're
 	// probably reused.
-	var psegments []*parserSegment
-	var variable string
-	searchers := make(map[string]*stringSearcher)
-	for _, segment := range segments {
-		if varRE.MatchString(segment) {
-			// Variable
-			if variable != "" {
-				// Two consecutive variables
-				return nil, fmt.Errorf("Two consecutive variables in format: %s, %s", variable, segment)
+	builder := &segmentBuilder{searchers: make(map[string]*stringSearcher), optionalAt: -1}
+	for i, token := range tokens {
+		if err := builder.add(token, i == len(tokens)-1); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := builder.flush(); err != nil {
+		return nil, err
+	}
+
+	if n := len(builder.segments); n > 0 {
+		last := builder.segments[n-1]
+		last.last = last.kind != stringValue && len(last.searchers) == 0
+	}
+
+	// Every escape starts with the regexp's literal prefix, if it has one, so
+	// only the places where the prefix occurs need to be checked for escapes.
+	escPrefix, _ := escRE.LiteralPrefix()
+	escAtRE := regexp.MustCompile(`^(?:` + options.EscapeRegex + `)`)
+
+	if options.legacy {
+		escPrefix = ""
+		for _, segment := range builder.segments {
+			searchers := append([]*stringSearcher{segment.required}, segment.searchers...)
+			for _, searcher := range searchers {
+				if searcher != nil && searcher.boyerMoore == nil {
+					searcher.boyerMoore = compileBoyerMoore(searcher.pattern)
+				}
 			}
+		}
+	}
+
+	variables := 0
+	for _, segment := range builder.segments {
+		if segment.variable != "" {
+			variables++
+		}
+	}
+
+	return &Parser{
+		escapeRE:         escRE,
+		escapeAtRE:       escAtRE,
+		escapePrefix:     escPrefix,
+		segments:         builder.segments,
+		unescapeCallback: options.Unescape,
+		variables:        variables,
+	}, nil
+}
 
-			variable = segment
+// formatToken is a piece of a format: a variable, a separator, or an
+// optional marker.
+type formatToken struct {
+	text     string
+	variable bool
+	kind     valueType
+	optional bool
+}
+
+func tokenizeFormat(format string, varRE *regexp.Regexp, unwrap unwrapCallback) ([]formatToken, error) {
+	var tokens []formatToken
+	addText := func(text string) {
+		for _, segment := range splitSegments(text, varRE) {
+			if varRE.MatchString(segment) {
+				tokens = append(tokens, formatToken{text: unwrap(segment), variable: true})
+			} else {
+				tokens = append(tokens, formatToken{text: segment})
+			}
+		}
+	}
+
+	for len(format) > 0 {
+		loc := formatSyntaxRE.FindStringSubmatchIndex(format)
+		if loc == nil {
+			addText(format)
+			break
+		}
+
+		addText(format[:loc[0]])
+		if format[loc[0]:loc[1]] == optionalMarker {
+			tokens = append(tokens, formatToken{text: optionalMarker, optional: true})
 		} else {
-			// Separator
-			searcher, ok := searchers[segment]
-			if !ok {
-				searcher = compileSearcher(segment)
-				searchers[segment] = searcher
+			name, typeName := format[loc[2]:loc[3]], format[loc[4]:loc[5]]
+			kind, err := parseValueType(typeName)
+			if err != nil {
+				return nil, fmt.Errorf("Variable %s: %s", name, err.Error())
 			}
 
-			varname := variable
-			if variable != "" {
-				varname = options.UnwrapVariable(variable)
+			tokens = append(tokens, formatToken{text: name, variable: true, kind: kind})
+		}
+
+		format = format[loc[1]:]
+	}
+
+	return tokens, nil
+}
+
+func parseValueType(name string) (valueType, error) {
+	for i, n := range valueTypeNames {
+		if n == name {
+			return valueType(i), nil
+		}
+	}
+
+	return stringValue, fmt.Errorf("Unknown type %q, must be one of: %s", name, strings.Join(valueTypeNames, ", "))
+}
+
+// segmentBuilder collects format tokens into parser segments.
+type segmentBuilder struct {
+	segments   []*parserSegment
+	searchers  map[string]*stringSearcher
+	variable   *formatToken
+	separator  string
+	optionalAt int
+}
+
+func (b *segmentBuilder) add(token formatToken, last bool) error {
+	switch {
+	case token.optional:
+		if b.variable == nil && b.separator == "" {
+			return fmt.Errorf("Optional marker must follow part of the format")
+		}
+
+		if last {
+			return fmt.Errorf("Optional marker must be followed by part of the format")
+		}
+
+		if b.optionalAt >= 0 {
+			return fmt.Errorf("Two consecutive optional markers in format")
+		}
+
+		b.optionalAt = len(b.separator)
+	case token.variable:
+		if b.variable != nil && b.separator == "" && b.variable.kind == stringValue {
+			// Only typed variables know where they end
+			return fmt.Errorf("Two consecutive variables in format: %s, %s", b.variable.text, token.text)
+		}
+
+		if err := b.flush(); err != nil {
+			return err
+		}
+
+		b.variable = &token
+	default:
+		b.separator += token.text
+	}
+
+	return nil
+}
+
+// flush adds a segment for the pending variable and separator, if any.
+func (b *segmentBuilder) flush() error {
+	if b.variable == nil && b.separator == "" {
+		return nil
+	}
+
+	segment := &parserSegment{separator: b.separator}
+	if b.variable != nil {
+		segment.variable = b.variable.text
+		segment.kind = b.variable.kind
+	}
+
+	if b.separator != "" {
+		for _, alt := range strings.Split(b.separator, alternativeMarker) {
+			if alt == "" {
+				return fmt.Errorf("Empty alternative in separator %q", b.separator)
 			}
 
-			psegments = append(psegments, &parserSegment{
-				variable: varname,
-				searcher: searcher,
-			})
+			searcher, ok := b.searchers[alt]
+			if !ok {
+				searcher = compileSearcher(alt)
+				b.searchers[alt] = searcher
+			}
 
-			variable = ""
+			segment.searchers = append(segment.searchers, searcher)
 		}
 	}
 
-	if variable != "" {
-		// If we ended with a variable, then add a parser segment for it.
-		psegments = append(psegments, &parserSegment{
-			variable: options.UnwrapVariable(variable),
-			searcher: nil,
-		})
+	if b.optionalAt >= 0 {
+		if len(segment.searchers) > 1 {
+			return fmt.Errorf("Separator %q can't have both alternatives and an optional marker", b.separator)
+		}
+
+		segment.optional = true
+		if b.optionalAt > 0 {
+			segment.required = compileSearcher(b.separator[:b.optionalAt])
+		}
 	}
 
-	return &Parser{
-		escapeRE:         escRE,
-		segments:         psegments,
-		unescapeCallback: options.Unescape,
-	}, nil
+	b.segments = append(b.segments, segment)
+	b.variable = nil
+	b.separator = ""
+	b.optionalAt = -1
+	return nil
 }
 
 func splitSegments(format string, varRE *regexp.Regexp) []string {
@@ -122,55 +386,367 @@ func splitSegments(format string, varRE *regexp.Regexp) []string {
 	return segments
 }
 
+// parsedValue is a variable from an optional part of the format, which is
+// kept until that part is known to match.
+type parsedValue struct {
+	key   string
+	value string
+}
+
+// Parse stores the variables from the line in output.  Values refer to the
+// line rather than copying it, except where they had to be unescaped.
 func (parser *Parser) Parse(line string, output ParserResultStorage) error {
 	// First, find all of the escape sequences in the input so we can skip over them
 	// when processing the line.
-	escapes := parser.escapeRE.FindAllStringIndex(line, -1)
+	escapes, list := parser.findEscapes(line)
+	if list != nil {
+		defer escapeLists.Put(list)
+	}
+
+	// Values after an optional marker are held back until the next marker or
+	// the end of the format, so that a partial match stores nothing.
+	var pendingValues [8]parsedValue
+	pending := pendingValues[:0]
+	optional := false
 
 	ptr := 0
-	for _, segment := range parser.segments {
-		if segment.variable == "" {
-			// Look for a delimiter at the beginning, don't read into a variable
-			_, eidx, escidx, err := segment.searcher.Search(line, ptr, escapes)
-			if err != nil {
-				return err
+	for i, segment := range parser.segments {
+		value, next, rest, end, err := parser.match(segment, line, ptr, escapes)
+		if err == NO_MATCH && optional {
+			// The optional part of the line is missing
+			return nil
+		} else if err != nil {
+			// On failure, next is where the line stopped matching
+			return parser.parseError(i, next, err)
+		}
+
+		if segment.variable != "" {
+			if optional {
+				pending = append(pending, parsedValue{segment.variable, value})
+			} else {
+				output.Store(segment.variable, value)
+			}
+		}
+
+		if segment.optional {
+			// Everything before this segment's optional marker matched
+			for _, v := range pending {
+				output.Store(v.key, v.value)
 			}
 
-			ptr = eidx
-			escapes = escapes[escidx:]
-		} else if segment.searcher == nil {
-			// Read the rest of the line into a variable
-			value := line[ptr:]
-			if len(escapes) > 0 {
-				value = parser.unescape(value, ptr, escapes)
+			pending = pending[:0]
+			optional = true
+			if end {
+				return nil
 			}
+		}
+
+		ptr = next
+		escapes = rest
+	}
+
+	for _, v := range pending {
+		output.Store(v.key, v.value)
+	}
 
-			output.Store(segment.variable, value)
-			ptr = len(line)
+	return nil
+}
+
+// match reads one segment from the line at ptr.  It returns the variable's
+// value, where the next segment starts and the escapes after that, and
+// whether the line ended before the segment's optional separator.  If the
+// segment doesn't match, it returns where the line stopped matching instead
+// of where the next segment starts.
+func (parser *Parser) match(segment *parserSegment, line string, ptr int, escapes [][]int) (string, int, [][]int, bool, error) {
+	if segment.variable != "" && segment.kind != stringValue {
+		return parser.matchTyped(segment, line, ptr, escapes)
+	}
+
+	end := false
+	idx, eidx, escidx, err := segment.search(line, ptr, escapes)
+	if err == NO_MATCH && segment.optional {
+		// Without the optional part, the variable ends at the required part of
+		// the separator or at the end of the line.
+		end = true
+		if segment.required != nil {
+			idx, eidx, escidx, err = segment.required.Search(line, ptr, escapes)
 		} else {
-			// Find separator,
-			idx, eidx, escidx, err := segment.searcher.Search(line, ptr, escapes)
-			if err != nil {
-				return err
+			idx, eidx, escidx, err = len(line), len(line), len(escapes), nil
+		}
+	}
+
+	if err != nil {
+		return "", segment.failure(line, ptr, escapes), nil, false, err
+	}
+
+	// Unescape the value only if we skipped over any escapes
+	value := line[ptr:idx]
+	if escidx > 0 && segment.variable != "" {
+		value = parser.unescape(value, ptr, escapes[0:escidx])
+	}
+
+	return value, eidx, escapes[escidx:], end, nil
+}
+
+// matchTyped reads a typed variable, which must be followed immediately by
+// its separator.
+func (parser *Parser) matchTyped(segment *parserSegment, line string, ptr int, escapes [][]int) (string, int, [][]int, bool, error) {
+	vend := segment.kind.scan(line, ptr, escapes)
+	if vend < 0 {
+		if segment.kind == quotedValue && ptr < len(line) && line[ptr] == '"' {
+			// The closing quote is missing
+			return "", len(line), nil, false, NO_MATCH
+		}
+
+		return "", ptr, nil, false, NO_MATCH
+	}
+
+	escidx := skipEscapes(escapes, vend)
+	value := line[ptr:vend]
+	voffset := ptr
+	if segment.kind == quotedValue && value != "-" {
+		value = value[1 : len(value)-1]
+		voffset++
+	}
+
+	if escidx > 0 {
+		value = parser.unescape(value, voffset, escapes[0:escidx])
+	}
+
+	if len(segment.searchers) == 0 {
+		if segment.last && vend < len(line) {
+			return "", vend, nil, false, NO_MATCH
+		}
+
+		return value, vend, escapes[escidx:], false, nil
+	}
+
+	for _, searcher := range segment.searchers {
+		if strings.HasPrefix(line[vend:], searcher.pattern) {
+			next := vend + len(searcher.pattern)
+			return value, next, escapes[skipEscapes(escapes, next):], false, nil
+		}
+	}
+
+	if segment.optional && (segment.required == nil || strings.HasPrefix(line[vend:], segment.required.pattern)) {
+		return value, vend, escapes[escidx:], true, nil
+	}
+
+	failure := vend
+	for _, searcher := range segment.searchers {
+		if end := vend + commonPrefix(line[vend:], searcher.pattern); end > failure {
+			failure = end
+		}
+	}
+
+	return "", failure, nil, false, NO_MATCH
+}
+
+// search finds the earliest of the segment's separators, or the end of the
+// line if it doesn't have one.
+func (segment *parserSegment) search(line string, start int, escapes [][]int) (int, int, int, error) {
+	if len(segment.searchers) == 0 {
+		return len(line), len(line), len(escapes), nil
+	}
+
+	idx, eidx, escidx, err := segment.searchers[0].Search(line, start, escapes)
+	for _, searcher := range segment.searchers[1:] {
+		i, e, esc, serr := searcher.Search(line, start, escapes)
+		if serr == nil && (err != nil || i < idx) {
+			idx, eidx, escidx, err = i, e, esc, nil
+		}
+	}
+
+	return idx, eidx, escidx, err
+}
+
+// failure returns where the line stops matching the segment's separators
+// after start: after the longest partial match of any of them, or the end of
+// the line if none of them starts anywhere.
+func (segment *parserSegment) failure(line string, start int, escapes [][]int) int {
+	result := -1
+	for _, searcher := range segment.searchers {
+		if end := searcher.partial(line, start, escapes); end > result {
+			result = end
+		}
+	}
+
+	if result < 0 {
+		return len(line)
+	}
+
+	return result
+}
+
+// skipEscapes returns the number of escapes that start before ptr.
+func skipEscapes(escapes [][]int, ptr int) int {
+	i := 0
+	for i < len(escapes) && escapes[i][0] < ptr {
+		i++
+	}
+
+	return i
+}
+
+// scan returns the end of the value of this type at ptr, or -1 if there
+// isn't one.  Missing values are logged as '-', which every type accepts.
+func (kind valueType) scan(line string, ptr int, escapes [][]int) int {
+	if ptr >= len(line) {
+		return -1
+	}
+
+	i := ptr
+	switch kind {
+	case quotedValue:
+		if line[i] == '-' {
+			return i + 1
+		} else if line[i] != '"' {
+			return -1
+		}
+
+		for i++; i < len(line); i++ {
+			// Skip over escaped quotes
+			for len(escapes) > 0 && escapes[0][1] <= i {
+				escapes = escapes[1:]
+			}
+
+			if len(escapes) > 0 && escapes[0][0] <= i {
+				i = escapes[0][1] - 1
+			} else if line[i] == '"' {
+				return i + 1
+			}
+		}
+
+		return -1
+	case intValue, floatValue:
+		if line[i] == '-' || line[i] == '+' {
+			i++
+		}
+
+		digits := scanDigits(line, i)
+		if kind == floatValue && digits < len(line) && line[digits] == '.' {
+			fraction := scanDigits(line, digits+1)
+			if fraction > digits+1 || digits > i {
+				digits = fraction
 			}
+		}
 
-			// Unescape the value only if we skipped over any escapes
-			value := line[ptr:idx]
-			if escidx > 0 {
-				value = parser.unescape(value, ptr, escapes[0:escidx])
-				escapes = escapes[escidx:]
+		if digits == i {
+			if line[ptr] == '-' {
+				// Missing value
+				return ptr + 1
 			}
 
-			output.Store(segment.variable, value)
-			ptr = eidx
+			return -1
+		}
+
+		if kind == floatValue && digits < len(line) && (line[digits] == 'e' || line[digits] == 'E') {
+			e := digits + 1
+			if e < len(line) && (line[e] == '-' || line[e] == '+') {
+				e++
+			}
+
+			if exp := scanDigits(line, e); exp > e {
+				digits = exp
+			}
 		}
+
+		return digits
+	case tokenValue:
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+
+		if i == ptr {
+			return -1
+		}
+
+		return i
 	}
 
-	return nil
+	return -1
+}
+
+func scanDigits(line string, i int) int {
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+
+	return i
+}
+
+func (parser *Parser) parseError(segment, offset int, err error) error {
+	if err != NO_MATCH {
+		return err
+	}
+
+	result := &ParseError{
+		Segment:   segment,
+		Variable:  parser.segments[segment].variable,
+		Separator: parser.segments[segment].separator,
+		Offset:    offset,
+	}
+
+	if parser.segments[segment].kind != stringValue {
+		result.Type = parser.segments[segment].kind.String()
+	}
+
+	return result
+}
+
+// escapeList holds the positions of the escapes in a line, and is pooled so
+// that its slice can be reused.
+type escapeList struct {
+	escapes [][]int
+}
+
+var escapeLists = sync.Pool{
+	New: func() interface{} { return &escapeList{escapes: make([][]int, 0, 16)} },
+}
+
+// findEscapes returns the positions of the escape sequences in the line.
+// If every escape starts with the same prefix, only the places where it
+// occurs are checked, and lines without it (most of them) aren't searched.
+// If the result came from escapeLists, the list is returned too, to be put
+// back when the caller is done with it.
+func (parser *Parser) findEscapes(line string) ([][]int, *escapeList) {
+	if parser.escapePrefix == "" {
+		return parser.escapeRE.FindAllStringIndex(line, -1), nil
+	}
+
+	var list *escapeList
+	var escapes [][]int
+	for ptr := 0; ptr < len(line); {
+		idx := strings.Index(line[ptr:], parser.escapePrefix)
+		if idx < 0 {
+			break
+		}
+
+		idx += ptr
+		if loc := parser.escapeAtRE.FindStringIndex(line[idx:]); loc != nil {
+			if list == nil {
+				list = escapeLists.Get().(*escapeList)
+				escapes = list.escapes[:0]
+			}
+
+			loc[0] += idx
+			loc[1] += idx
+			escapes = append(escapes, loc)
+			ptr = loc[1]
+		} else {
+			ptr = idx + 1
+		}
+	}
+
+	if list != nil {
+		list.escapes = escapes
+	}
+
+	return escapes, list
 }
 
 func (parser *Parser) ParseToMap(line string) (map[string]string, error) {
-	result := make(parserResultMap)
+	result := make(parserResultMap, parser.variables)
 	err := parser.Parse(line, result)
 	if err != nil {
 		return nil, err
@@ -179,14 +755,48 @@ func (parser *Parser) ParseToMap(line string) (map[string]string, error) {
 	}
 }
 
+// ParseToPooledMap is like ParseToMap, but reuses maps given back to
+// Release, so that parsing many lines doesn't allocate a map for each.
+func (parser *Parser) ParseToPooledMap(line string) (map[string]string, error) {
+	result, ok := parser.results.Get().(parserResultMap)
+	if !ok {
+		result = make(parserResultMap, parser.variables)
+	}
+
+	if err := parser.Parse(line, result); err != nil {
+		parser.Release(result)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Release gives a map from ParseToPooledMap back to the parser.  Neither the
+// map nor the caller's references to it may be used afterwards, though the
+// values taken from it may.
+func (parser *Parser) Release(result map[string]string) {
+	for k := range result {
+		delete(result, k)
+	}
+
+	parser.results.Put(parserResultMap(result))
+}
+
 type parserResultMap map[string]string
 
 func (m parserResultMap) Store(key, value string) {
 	m[key] = value
 }
 
+// Buffers for unescaping values
+var unescapeBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
 func (parser *Parser) unescape(match string, offset int, escapes [][]int) string {
-	var buf bytes.Buffer
+	buf := unescapeBuffers.Get().(*bytes.Buffer)
+	defer unescapeBuffers.Put(buf)
+	buf.Reset()
 	last := 0
 
 	for _, esc := range escapes {
@@ -198,7 +808,7 @@ func (parser *Parser) unescape(match string, offset int, escapes [][]int) string
 		buf.WriteString(match[last:escStart])
 
 		// Unescape into buffer
-		parser.unescapeCallback(match[escStart:escEnd], &buf)
+		parser.unescapeCallback(match[escStart:escEnd], buf)
 
 		// Advance last pointer
 		last = escEnd
@@ -210,111 +820,83 @@ func (parser *Parser) unescape(match string, offset int, escapes [][]int) string
 	return buf.String()
 }
 
+// stringSearcher finds a separator in a line, skipping over escapes.
+// Separators are usually a few bytes long, for which strings.Index is
+// faster than Boyer-Moore, which is only used for ParserOptions.legacy.
 type stringSearcher struct {
-	pattern      string
-	badChars     [256]int
-	goodSuffixes []int
+	pattern    string
+	boyerMoore *boyerMoore
 }
 
 func compileSearcher(pattern string) *stringSearcher {
-	result := &stringSearcher{pattern: pattern}
-	length := len(pattern)
-	last := length - 1
+	return &stringSearcher{pattern: pattern}
+}
 
-	// Bad character rule
-	for i := 0; i < 256; i++ {
-		result.badChars[i] = length
-	}
-	for i := 0; i < length; i++ {
-		result.badChars[pattern[i]] = last - i
+// Search returns the start and end of the first match at or after start
+// that doesn't overlap an escape, and the number of escapes before it.
+func (search *stringSearcher) Search(line string, start int, escapes [][]int) (int, int, int, error) {
+	if search.boyerMoore != nil {
+		return search.boyerMoore.search(search.pattern, line, start, escapes)
 	}
 
-	// Good suffix rule - http://www-igm.univ-mlv.fr/~lecroq/string/node14.html
-
-	// For each position i, pattern[:i+1] has the same suffix as pattern for suffixes[i] bytes,
-	// or: pattern[i-suffixes[i]+1:i+1] == pattern[len(pattern)-suffixes[i]:]
-	suffixes := make([]int, length)
-
-	g := last
-	f := last - 1
-	suffixes[last] = length
+	escidx := 0
 
-	for i := last - 1; i >= 0; i-- {
-		if i > g && suffixes[i+last-f] < i-g {
-			suffixes[i] = suffixes[i+last-f]
-		} else {
-			if i < g {
-				g = i
-			}
-			f = i
-			for g >= 0 && pattern[g] == pattern[g+last-f] {
-				g--
-			}
-			suffixes[i] = f - g
+	for start <= len(line)-len(search.pattern) {
+		idx := strings.Index(line[start:], search.pattern)
+		if idx < 0 {
+			break
 		}
-	}
 
-	// Build jump table based on matching suffixes, above.
+		i := start + idx
+		end := i + len(search.pattern)
 
-	result.goodSuffixes = make([]int, length)
-	for i := 0; i < length; i++ {
-		result.goodSuffixes[i] = length
-	}
+		// Skip over escapes we've already passed
+		for escidx < len(escapes) && escapes[escidx][1] <= i {
+			escidx++
+		}
 
-	j := 0
-	for i := last; i >= 0; i-- {
-		if suffixes[i] == i+1 {
-			for ; j < last-i; j++ {
-				if result.goodSuffixes[j] == length {
-					result.goodSuffixes[j] = last - i
-				}
-			}
+		// Look again after the next escape if the match overlaps it
+		if escidx < len(escapes) && escapes[escidx][0] < end {
+			start = escapes[escidx][1]
+			continue
 		}
-	}
 
-	for i := 0; i < last; i++ {
-		result.goodSuffixes[last-suffixes[i]] = last - i
+		return i, end, escidx, nil
 	}
 
-	return result
+	return 0, 0, 0, NO_MATCH
 }
 
-func (search *stringSearcher) Search(line string, start int, escapes [][]int) (int, int, int, error) {
-	escidx := 0
-
-	for i := start; i <= len(line)-len(search.pattern); {
-		j := len(search.pattern) - 1
-
-		// Skip over escapes we've already passed
-		for escidx < len(escapes) && escapes[escidx][1] <= i {
-			escidx++
+// partial returns the end of the longest partial match of the pattern at or
+// after start that doesn't begin inside an escape, or -1 if the pattern's
+// first byte doesn't occur.
+func (search *stringSearcher) partial(line string, start int, escapes [][]int) int {
+	result := -1
+	longest := 0
+	for i := start; i < len(line); i++ {
+		for len(escapes) > 0 && escapes[0][1] <= i {
+			escapes = escapes[1:]
 		}
 
-		// Skip i over the next escape if we're in the middle of it
-		if escidx < len(escapes) && escapes[escidx][0] <= (j+i) {
-			i = escapes[escidx][1]
+		if len(escapes) > 0 && escapes[0][0] <= i {
+			i = escapes[0][1] - 1
 			continue
 		}
 
-		// Perform check
-		for j >= 0 && search.pattern[j] == line[i+j] {
-			j--
-		}
-		if j < 0 {
-			// Matched
-			return i, i + len(search.pattern), escidx, nil
+		if n := commonPrefix(line[i:], search.pattern); n > longest {
+			result, longest = i+n, n
 		}
+	}
 
-		// No match
-		bc := search.badChars[line[i+j]] - len(search.pattern) + 1 + j
-		gs := search.goodSuffixes[j]
+	return result
+}
 
-		if bc > gs {
-			i += bc
-		} else {
-			i += gs
-		}
+// commonPrefix returns the length of the longest common prefix of a and b.
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
 	}
 
-	return 0, 0, 0, NO_MATCH
+	return n
 }
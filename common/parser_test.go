@@ -1,6 +1,8 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
 	"testing"
 )
@@ -17,7 +19,7 @@ func NewTestParserRaw(format string) (*Parser, error) {
 func NewTestParser(t *testing.T, format string) *Parser {
 	p, err := NewTestParserRaw(format)
 	if err != nil {
-		t.Fatal("Parser constructor failed: %s", err.Error())
+		t.Fatalf("Parser constructor failed: %s", err.Error())
 	}
 
 	return p
@@ -100,3 +102,297 @@ func TestInitErrors(t *testing.T) {
 		t.Fatal("Should not allow two consecutive variables")
 	}
 }
+
+func TestParseError(t *testing.T) {
+	parser := NewTestParser(t, `$0 [$1] "$2"`)
+	r := make(testParseResult, 0)
+	err := parser.Parse(`a [b] "c`, &r)
+
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected ParseError, got %v", err)
+	}
+
+	// The closing quote was expected at the end of the line
+	if perr.Segment != 2 || perr.Variable != "2" || perr.Separator != `"` || perr.Offset != 8 {
+		t.Errorf("Unexpected error: %+v", perr)
+	}
+
+	if !errors.Is(err, NO_MATCH) {
+		t.Error("ParseError should match NO_MATCH")
+	}
+
+	// Offset is where the line stopped matching, not where the segment
+	// started
+	cases := []struct {
+		line   string
+		offset int
+	}{
+		{`a [b c`, 6},
+		{`a [b] c`, 6},
+		{`a [b] x] c`, 6},
+	}
+
+	for _, c := range cases {
+		err = parser.Parse(c.line, &r)
+		if perr, ok := err.(*ParseError); !ok || perr.Segment != 1 || perr.Variable != "1" || perr.Separator != `] "` || perr.Offset != c.offset {
+			t.Errorf("Unexpected error for %q: %v, expected offset %d", c.line, err, c.offset)
+		}
+	}
+}
+
+func TestTypedVariables(t *testing.T) {
+	parser := NewTestParser(t, `${0:int}${1:quoted}${2:float} ${3:token}$4`)
+	parseTest(t, parser, `200"GET / HTTP/1.1"0.25 abc def`, "200", "GET / HTTP/1.1", "0.25", "abc", " def")
+	parseTest(t, parser, `-"say \"hi\""1e3 x`, "-", `say "hi"`, "1e3", "x", "")
+	parseTest(t, parser, `404--.5 -y`, "404", "-", "-.5", "-y", "")
+	parseTest(t, parser, `404-- -y`, "404", "-", "-", "-y", "")
+	parseTestError(t, parser, `x"a"1 b`)
+	parseTestError(t, parser, `1a"1 b`)
+	parseTestError(t, parser, `1"a"1  b`)
+
+	parser = NewTestParser(t, `$0 ${1:quoted} ${2:int}`)
+	parseTest(t, parser, `a - 5`, "a", "-", "5")
+	parseTest(t, parser, `a "b c" 5`, "a", "b c", "5")
+	parseTestError(t, parser, `a b 5`)
+	parseTestError(t, parser, `a - 5 6`)
+
+	if _, err := NewTestParserRaw("${0:number}"); err == nil {
+		t.Error("Should not allow unknown types")
+	}
+
+	if _, err := NewTestParserRaw("$0${1:int}"); err == nil {
+		t.Error("Should not allow untyped variable before another variable")
+	}
+}
+
+func TestTrailingTypedVariable(t *testing.T) {
+	// A typed variable at the end of the format must match the rest of the
+	// line, unlike a string variable, which takes whatever is left
+	cases := []struct {
+		format string
+		good   string
+		value  string
+		bad    string
+		offset int
+	}{
+		{`$0 ${1:int}`, `a 200`, "200", `a 200 0.25`, 5},
+		{`$0 ${1:float}`, `a 0.25`, "0.25", `a 0.25s`, 6},
+		{`$0 ${1:token}`, `a b`, "b", `a b c`, 3},
+		{`$0 ${1:quoted}`, `a "b c"`, "b c", `a "b" c`, 5},
+		{`$0 ${1:int}`, `a -`, "-", `a - 1`, 3},
+	}
+
+	for _, c := range cases {
+		parser := NewTestParser(t, c.format)
+		parseTest(t, parser, c.good, "a", c.value)
+
+		r := make(testParseResult, 0)
+		err := parser.Parse(c.bad, &r)
+		if perr, ok := err.(*ParseError); !ok || perr.Offset != c.offset {
+			t.Errorf("Format %q, line %q: unexpected error %v, expected offset %d", c.format, c.bad, err, c.offset)
+		}
+	}
+
+	parser := NewTestParser(t, `$0 $1`)
+	parseTest(t, parser, `a 200 0.25`, "a", "200 0.25")
+
+	// With a separator after it, a typed variable is no longer last
+	parser = NewTestParser(t, `$0 ${1:int};$2`)
+	parseTest(t, parser, `a 200;x y`, "a", "200", "x y")
+}
+
+func TestAlternativeSeparators(t *testing.T) {
+	parser := NewTestParser(t, "$0 $|\t$1,$|;$2")
+	parseTest(t, parser, "a b,c", "a", "b", "c")
+	parseTest(t, parser, "a\tb;c", "a", "b", "c")
+	parseTest(t, parser, "a b;c,d", "a", "b", "c,d")
+	parseTestError(t, parser, "a b:c")
+
+	parser = NewTestParser(t, "${0:int} $|, $1")
+	parseTest(t, parser, "1, b", "1", "b")
+	parseTestError(t, parser, "1; b")
+
+	if _, err := NewTestParserRaw("$0 $|$1"); err == nil {
+		t.Error("Should not allow empty alternatives")
+	}
+}
+
+func TestOptionalSegments(t *testing.T) {
+	parser := NewTestParser(t, `$0 [$1]$? "$2"$? $3`)
+	parseTest(t, parser, `a [b] "c" d`, "a", "b", "c", "d")
+	parseTest(t, parser, `a [b] "c"`, "a", "b", "c")
+	parseTest(t, parser, `a [b]`, "a", "b")
+	parseTest(t, parser, `a [b] "c`, "a", "b")
+	parseTestError(t, parser, `a [b`)
+
+	parser = NewTestParser(t, `$0$? $1 $2`)
+	parseTest(t, parser, `a b c`, "a", "b", "c")
+	parseTest(t, parser, `a b`, "a")
+	parseTest(t, parser, `a`, "a")
+
+	parser = NewTestParser(t, `${0:int}$? ${1:float}`)
+	parseTest(t, parser, `1 2.5`, "1", "2.5")
+	parseTest(t, parser, `1`, "1")
+	parseTest(t, parser, `1 x`, "1")
+
+	for _, format := range []string{"$?$0", "$0 $?", "$0 $?$? $1", "$0 $?$|\t$1"} {
+		if _, err := NewTestParserRaw(format); err == nil {
+			t.Errorf("Should not allow format: %q", format)
+		}
+	}
+}
+
+func TestTypedParseError(t *testing.T) {
+	parser := NewTestParser(t, `$0 ${1:int} $2`)
+	r := make(testParseResult, 0)
+	err := parser.Parse(`a b c`, &r)
+	if perr, ok := err.(*ParseError); !ok || perr.Segment != 1 || perr.Type != "int" || perr.Offset != 2 {
+		t.Errorf("Unexpected error: %v", err)
+	} else if perr.Position() != `segment 1 (1): expected int value followed by " "` {
+		t.Errorf("Unexpected position: %s", perr.Position())
+	}
+
+	// After the value, the separator was expected
+	err = parser.Parse(`a 12x c`, &r)
+	if perr, ok := err.(*ParseError); !ok || perr.Offset != 4 {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestParseToPooledMap(t *testing.T) {
+	parser := NewTestParser(t, `$0 "$1"$? $2`)
+	result, err := parser.ParseToPooledMap(`a "b \"c\"" d`)
+	if err != nil {
+		t.Fatalf("ParseToPooledMap failed: %s", err.Error())
+	}
+
+	if len(result) != 3 || result["0"] != "a" || result["1"] != `b "c"` || result["2"] != "d" {
+		t.Errorf("Unexpected result: %v", result)
+	}
+
+	parser.Release(result)
+	if len(result) != 0 {
+		t.Errorf("Release should clear the map: %v", result)
+	}
+
+	// Values from previous lines must not be left in reused maps
+	result, err = parser.ParseToPooledMap(`e "f"`)
+	if err != nil {
+		t.Fatalf("ParseToPooledMap failed: %s", err.Error())
+	}
+
+	if len(result) != 2 || result["0"] != "e" || result["1"] != "f" {
+		t.Errorf("Unexpected result: %v", result)
+	}
+
+	if _, err := parser.ParseToPooledMap(`g h`); err == nil {
+		t.Error("ParseToPooledMap should fail for lines that don't match")
+	}
+}
+
+func TestEscapesAfterPrefix(t *testing.T) {
+	// Backslashes that don't start an escape are ordinary characters
+	parser := NewTestParser(t, `"$0" "$1"`)
+	parseTest(t, parser, `"a\q" "\"b\" \t\""`, `a\q`, "\"b\" \t\"")
+	parseTest(t, parser, `"\\" "x"`, `\`, `x`)
+}
+
+// Benchmarks parse a typical access log line with nginx's variable syntax.
+const (
+	benchmarkFormat  = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" $request_time`
+	benchmarkLine    = `10.0.0.1 - - [18/Oct/2026:10:00:00 +0000] "GET /users/123/orders?page=2 HTTP/1.1" 200 5120 "https://example.com/users/123" "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36" 0.042`
+	benchmarkEscaped = `10.0.0.1 - - [18/Oct/2026:10:00:00 +0000] "GET /search?q=\x22quoted\x22 HTTP/1.1" 200 5120 "-" "Agent \"with\" quotes" 0.042`
+)
+
+// newBenchmarkParser creates a parser for benchmarkFormat.  Legacy parsers
+// search lines the way the parser did before it was sped up.
+func newBenchmarkParser(tb testing.TB, legacy bool) *Parser {
+	parser, err := NewParser(benchmarkFormat, &ParserOptions{
+		VariableRegex:  `\$[a-zA-Z0-9_]+`,
+		EscapeRegex:    `\\x[0-9a-fA-F]{2}|\\[\\"]|\\u[0-9a-fA-F]{4}`,
+		Unescape:       UnescapeCommon,
+		UnwrapVariable: func(v string) string { return v[1:] },
+		legacy:         legacy,
+	})
+	if err != nil {
+		tb.Fatalf("Parser constructor failed: %s", err.Error())
+	}
+
+	return parser
+}
+
+func TestLegacyParser(t *testing.T) {
+	parser := newBenchmarkParser(t, false)
+	legacy := newBenchmarkParser(t, true)
+	for _, line := range []string{benchmarkLine, benchmarkEscaped, `10.0.0.1 - - [x] "GET / HTTP/1.1" 200`} {
+		expected, expectedErr := parser.ParseToMap(line)
+		actual, err := legacy.ParseToMap(line)
+		if (err == nil) != (expectedErr == nil) || fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("Legacy parser gave %v, %v for %q, expected %v, %v", actual, err, line, expected, expectedErr)
+		}
+	}
+
+	// Boyer-Moore must skip over escapes too
+	parser = NewTestParser(t, `"$0" $1`)
+	parser.segments[0].searchers[0].boyerMoore = compileBoyerMoore(`" `)
+	parseTest(t, parser, `"a\" b" c`, `a" b`, "c")
+}
+
+type discardResult struct{}
+
+func (discardResult) Store(key, value string) {}
+
+func benchmarkParse(b *testing.B, line string, legacy bool) {
+	parser := newBenchmarkParser(b, legacy)
+	b.SetBytes(int64(len(line)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := parser.Parse(line, discardResult{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkParseToMap(b *testing.B, line string, legacy bool) {
+	parser := newBenchmarkParser(b, legacy)
+	b.SetBytes(int64(len(line)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.ParseToMap(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkParseToPooledMap(b *testing.B, line string, legacy bool) {
+	parser := newBenchmarkParser(b, legacy)
+	b.SetBytes(int64(len(line)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result, err := parser.ParseToPooledMap(line)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		parser.Release(result)
+	}
+}
+
+func BenchmarkParse(b *testing.B)             { benchmarkParse(b, benchmarkLine, false) }
+func BenchmarkParseEscaped(b *testing.B)      { benchmarkParse(b, benchmarkEscaped, false) }
+func BenchmarkParseToMap(b *testing.B)        { benchmarkParseToMap(b, benchmarkLine, false) }
+func BenchmarkParseToMapEscaped(b *testing.B) { benchmarkParseToMap(b, benchmarkEscaped, false) }
+func BenchmarkParseToPooledMap(b *testing.B)  { benchmarkParseToPooledMap(b, benchmarkLine, false) }
+func BenchmarkParseToPooledMapEscaped(b *testing.B) {
+	benchmarkParseToPooledMap(b, benchmarkEscaped, false)
+}
+
+// The same, searching lines the way the parser did before it was sped up
+func BenchmarkParseLegacy(b *testing.B)             { benchmarkParse(b, benchmarkLine, true) }
+func BenchmarkParseEscapedLegacy(b *testing.B)      { benchmarkParse(b, benchmarkEscaped, true) }
+func BenchmarkParseToMapLegacy(b *testing.B)        { benchmarkParseToMap(b, benchmarkLine, true) }
+func BenchmarkParseToMapEscapedLegacy(b *testing.B) { benchmarkParseToMap(b, benchmarkEscaped, true) }
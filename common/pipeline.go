@@ -0,0 +1,472 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+// Options that belong to the pipeline itself rather than its handler
+var pipelineOptions = map[string]bool{
+	"name":         true,
+	"handler":      true,
+	"in":           true,
+	"out":          true,
+	"deadletter":   true,
+	"custom":       true,
+	"role":         true,
+	"roleinstance": true,
+}
+
+// Property of rejected lines sent as traces that holds the error
+const rejectedErrorProperty = "ParseError"
+
+// pipeline reads lines from one input, optionally copies them to an output,
+// and passes them to a LogHandler.  Telemetry from the handler gets the
+// pipeline's properties before it is forwarded.
+type pipeline struct {
+	name            string
+	infile          string
+	outfile         string
+	output          OutputSettings
+	mirror          mirrorSettings
+	sinks           []sink
+	deadLetterFile  string
+	forwardRejected bool
+	custom          customProperties
+	role            string
+	roleInstance    string
+	lock            sync.RWMutex
+	processors      processorChain
+	handlerLock     sync.RWMutex
+	handler         LogHandler
+	msgs            *log.Logger
+	logReader       *LogReader
+	logWriter       *LogWriter
+	deadLetter      *LogWriter
+	forwarder       *forwarder
+	swap            chan *pipeline
+	resets          chan struct{}
+	stopped         chan struct{}
+	errors          *errorSummary
+	errorWait       time.Duration
+	flushWait       time.Duration
+	workers         *workerPool
+}
+
+// newConfigPipeline creates a pipeline from an entry in the configuration
+// file's pipeline list.  If factories is specified, the pipeline's handler
+// option selects which to use; otherwise, factory is used.  Handler options
+// that appear at the top level of the file apply to every pipeline unless
+// the pipeline overrides them, and so do their environment variables.
+func newConfigPipeline(index int, values, defaults map[string]interface{}, factory HandlerFactory, factories map[string]HandlerFactory) (*pipeline, error) {
+	label := fmt.Sprintf("pipeline %d", index+1)
+	if factories != nil {
+		handlerName, _ := values["handler"].(string)
+		if factory = factories[handlerName]; factory == nil {
+			return nil, fmt.Errorf("%s: Invalid handler %q, must be one of: %s", label, handlerName, handlerNames(factories))
+		}
+	}
+
+	result := &pipeline{}
+	flags := flag.NewFlagSet(label, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&result.name, "name", "", "Pipeline name, used in output messages")
+	flags.StringVar(&result.infile, "in", "", "Input file, '-' for stdin, or 'http:host:port' for handlers that receive HTTP requests (required)")
+	flags.StringVar(&result.outfile, "out", "", "Output file, '-' for stdout, 'stderr' for stderr")
+	result.output.register(flags)
+	result.mirror.register(flags)
+	flags.StringVar(&result.deadLetterFile, "deadletter", "", "Output file for lines that couldn't be processed, with the reason")
+	flags.BoolVar(&result.forwardRejected, "forwardrejected", false, "Send lines that couldn't be processed as traces")
+	flags.Var(&result.custom, "custom", "Include custom property in telemetry like 'key=value'")
+	flags.StringVar(&result.role, "role", "", "Telemetry role name")
+	flags.StringVar(&result.roleInstance, "roleinstance", "", "Telemetry role instance")
+	if factories != nil {
+		flags.String("handler", "", "Log handler")
+	}
+
+	result.handler = factory(flags)
+
+	// Options that can be given several times would add to the inherited
+	// values rather than replace them, so skip the ones the pipeline sets.
+	inherited := make(map[string]interface{})
+	flags.VisitAll(func(f *flag.Flag) {
+		if _, ok := values[f.Name]; ok || pipelineOptions[f.Name] {
+			return
+		}
+
+		if v, ok := defaults[f.Name]; ok {
+			inherited[f.Name] = v
+		} else if _, value := envValue(f.Name); value != "" {
+			inherited[f.Name] = escapeEnv(value)
+		}
+	})
+
+	if err := applyConfig(flags, inherited, nil); err != nil {
+		return nil, err
+	}
+
+	if err := applyConfig(flags, values, nil); err != nil {
+		return nil, fmt.Errorf("%s: %s", label, err.Error())
+	}
+
+	if result.infile == "" {
+		return nil, fmt.Errorf("%s: Must specify input file", label)
+	}
+
+	if result.name == "" {
+		result.name = fmt.Sprintf("%d", index+1)
+	}
+
+	return result, nil
+}
+
+func handlerNames(factories map[string]HandlerFactory) string {
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (p *pipeline) start(name string, opts *options, fwd *forwarder, done chan *pipeline) error {
+	p.forwarder = fwd
+	p.processors = p.newProcessors()
+	p.swap = make(chan *pipeline)
+	p.resets = make(chan struct{}, 1)
+	p.stopped = make(chan struct{})
+	p.errors = newErrorSummary()
+	p.errorWait = opts.errorSummary
+	p.flushWait = opts.flushWait
+	if opts.workers > 1 {
+		p.workers = newWorkerPool(opts.workers)
+	}
+
+	prefix := fmt.Sprintf("%s: ", name)
+	if p.name != "" {
+		prefix = fmt.Sprintf("%s[%s]: ", name, p.name)
+	}
+
+	p.msgs = log.New(os.Stderr, prefix, log.Ldate|log.Ltime)
+	if opts.quiet {
+		p.msgs.SetOutput(ioutil.Discard)
+	}
+
+	if p.outfile != "" {
+		var err error
+		p.logWriter, err = NewLogWriter(p.outfile, p.output)
+		if err != nil {
+			return fmt.Errorf("Error initializing log writer: %s", err.Error())
+		}
+	} else {
+		p.logWriter = NewNilLogWriter()
+	}
+
+	if p.deadLetterFile != "" {
+		var err error
+		p.deadLetter, err = NewLogWriter(p.deadLetterFile, OutputSettings{})
+		if err != nil {
+			return fmt.Errorf("Error initializing dead letter output: %s", err.Error())
+		}
+	} else {
+		p.deadLetter = NewNilLogWriter()
+	}
+
+	var err error
+	if p.sinks, err = p.mirror.newSinks(p.msgs); err != nil {
+		return err
+	}
+
+	err = p.handler.Initialize(p.msgs, p)
+	if err != nil {
+		return fmt.Errorf("Error initializing log handler: %s", err.Error())
+	}
+
+	if isHttpInput(p.infile) {
+		if _, ok := p.handler.(http.Handler); !ok {
+			return fmt.Errorf("Error initializing log reader: The handler can't receive HTTP requests")
+		}
+
+		p.logReader, err = listenHttp(p.infile, http.HandlerFunc(p.serveHTTP))
+	} else {
+		p.logReader, err = MakeLogReader(p.infile, opts.lineLimits())
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error initializing log reader: %s", err.Error())
+	}
+
+	go p.readLoop(done)
+	return nil
+}
+
+// sameInput returns whether next reads and writes the same files as p.
+func (p *pipeline) sameInput(next *pipeline) bool {
+	return p.name == next.name && p.infile == next.infile && p.outfile == next.outfile && p.output == next.output && p.mirror.equal(&next.mirror) && p.deadLetterFile == next.deadLetterFile
+}
+
+// prepare initializes next's handler so that it can replace p's.
+func (p *pipeline) prepare(next *pipeline) error {
+	if err := next.handler.Initialize(p.msgs, p); err != nil {
+		return fmt.Errorf("Error initializing log handler: %s", err.Error())
+	}
+
+	return nil
+}
+
+// reload takes the properties and the prepared handler from next.  Lines
+// already given to the old handler are finished before it is closed.
+func (p *pipeline) reload(next *pipeline) {
+	p.lock.Lock()
+	p.processors = next.newProcessors()
+	p.lock.Unlock()
+
+	select {
+	case p.swap <- next:
+	case <-p.stopped:
+		closeHandler(next.handler)
+	}
+}
+
+// resetOutputs asks the pipeline to reopen its output and dead letter output.
+func (p *pipeline) resetOutputs() {
+	select {
+	case p.resets <- struct{}{}:
+	default:
+		// Already pending
+	}
+}
+
+func (p *pipeline) readLoop(done chan *pipeline) {
+	// Errors are summarized every errorWait, or reported right away if it's 0
+	var summaries <-chan time.Time
+	if p.errorWait > 0 {
+		ticker := time.NewTicker(p.errorWait)
+		defer ticker.Stop()
+		summaries = ticker.C
+	}
+
+main:
+	for {
+		// Stop reading while the workers are busy
+		events := p.logReader.events
+		var parsed <-chan struct{}
+		if p.workers != nil {
+			if p.workers.full() {
+				events = nil
+			}
+
+			parsed = p.workers.next()
+		}
+
+		select {
+		case <-summaries:
+			p.errors.report(p.msgs, p.errorWait)
+			p.logReader.stats.report(p.msgs, p.errorWait)
+		case next := <-p.swap:
+			// Lines already given to the old handler are tracked first,
+			// and requests it's serving are finished
+			p.drain()
+			p.handlerLock.Lock()
+			previous := p.handler
+			p.handler = next.handler
+			p.handlerLock.Unlock()
+			closeHandler(previous)
+			p.forwardRejected = next.forwardRejected
+		case <-p.resets:
+			p.logWriter.Reset()
+			p.deadLetter.Reset()
+		case <-parsed:
+			p.finish(p.workers.take())
+		case event := <-events:
+			if event.data != "" {
+				p.logWriter.Write(event.data)
+				p.receive(event.data, event.partial)
+			}
+
+			if event.err != nil {
+				p.msgs.Println(event.err.Error())
+			}
+
+			if event.closed {
+				p.msgs.Println("Input closed.")
+				break main
+			}
+		case event := <-p.logWriter.events:
+			if event.err != nil {
+				p.msgs.Printf("Log output encountered error: %s", event.err.Error())
+			}
+
+			if event.closed {
+				p.msgs.Println("Log output closed. Aborting.")
+				break main
+			}
+		case event := <-p.deadLetter.events:
+			if event.err != nil {
+				p.msgs.Printf("Dead letter output encountered error: %s", event.err.Error())
+			}
+
+			if event.closed {
+				p.msgs.Println("Dead letter output closed.")
+				p.deadLetter = NewNilLogWriter()
+			}
+		}
+	}
+
+	p.drain()
+	if p.workers != nil {
+		p.workers.close()
+	}
+
+	closeHandler(p.handler)
+	p.errors.report(p.msgs, 0)
+	p.logReader.stats.report(p.msgs, 0)
+	p.logWriter.Close()
+	p.deadLetter.Close()
+	closeSinks(p.sinks, p.flushWait)
+
+	// Wait for the output to be written out, which matters with -outblock,
+	// but not forever if nothing is reading it
+	select {
+	case <-p.logWriter.done:
+	case <-time.After(p.flushWait):
+		p.msgs.Println("Timed out waiting for the log output to be written.")
+	}
+
+	close(p.stopped)
+	done <- p
+}
+
+// serveHTTP passes a request from an HTTP input to the handler.
+func (p *pipeline) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handlerLock.RLock()
+	defer p.handlerLock.RUnlock()
+
+	if handler, ok := p.handler.(http.Handler); ok {
+		handler.ServeHTTP(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// receive gives a line to the handler, or to the workers if the handler can
+// parse lines concurrently.  Partial lines from a ConcurrentHandler are
+// always parsed here so that their telemetry can be marked.
+func (p *pipeline) receive(line string, partial bool) {
+	if handler, ok := p.handler.(ConcurrentHandler); ok {
+		if p.workers != nil {
+			p.workers.add(handler, line, partial)
+			return
+		}
+
+		if partial {
+			job := &parseJob{line: line, partial: true}
+			job.telemetry, job.err = handler.Parse(line)
+			p.finish(job)
+			return
+		}
+	}
+
+	var err error
+	if handler, ok := p.handler.(PartialLineHandler); ok && partial {
+		err = handler.ReceivePartial(line)
+	} else {
+		err = p.handler.Receive(line)
+	}
+
+	if err != nil {
+		p.reject(line, err)
+	}
+}
+
+// finish tracks the telemetry from a line that was parsed by a
+// ConcurrentHandler.
+func (p *pipeline) finish(job *parseJob) {
+	if job.err != nil {
+		p.reject(job.line, job.err)
+	} else if job.telemetry != nil {
+		if job.partial {
+			job.telemetry.GetProperties()[PartialLineProperty] = "true"
+		}
+
+		p.Track(job.telemetry)
+	}
+}
+
+// drain waits for the workers to parse the lines given to them, and tracks
+// the telemetry in order.
+func (p *pipeline) drain() {
+	if p.workers == nil {
+		return
+	}
+
+	for p.workers.next() != nil {
+		p.finish(p.workers.take())
+	}
+}
+
+// reject reports a line that the handler couldn't process, writes it to the
+// dead letter output, and optionally sends it as a trace.
+func (p *pipeline) reject(line string, err error) {
+	if p.errorWait > 0 {
+		log.Printf("Error processing log line. Error: %s Original log line: %s", err.Error(), line)
+		p.errors.add(err, line)
+	} else {
+		p.msgs.Println(fmt.Sprintf("Error processing log line. Error: %s Original log line: %s", err.Error(), line))
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	p.deadLetter.Write(fmt.Sprintf("%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339), err.Error(), line))
+
+	if p.forwardRejected {
+		t := appinsights.NewTraceTelemetry(line, appinsights.Warning)
+		t.Properties[rejectedErrorProperty] = err.Error()
+		p.Track(t)
+	}
+}
+
+// closeHandler closes handlers that implement io.Closer, e.g. to send out
+// pending batches.
+func closeHandler(handler LogHandler) {
+	if closer, ok := handler.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// newProcessors returns the processors that run on telemetry from this
+// pipeline before the forwarder's.
+func (p *pipeline) newProcessors() processorChain {
+	return processorChain{&contextProcessor{
+		custom:       p.custom,
+		role:         p.role,
+		roleInstance: p.roleInstance,
+	}}
+}
+
+// Track runs the telemetry through the pipeline's processors and forwards it.
+func (p *pipeline) Track(t appinsights.Telemetry) {
+	if t == nil {
+		return
+	}
+
+	p.lock.RLock()
+	processors := p.processors
+	p.lock.RUnlock()
+
+	item := &Item{Telemetry: t, SampleRate: 100}
+	if processors.Process(item) {
+		p.forwarder.send(item, p.sinks)
+	}
+}
@@ -0,0 +1,238 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+func TestPipelineReject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+	deadLetterPath := filepath.Join(dir, "rejected.log")
+	sinkPath := filepath.Join(dir, "telemetry.jsonl")
+
+	fwd, err := newForwarder(&options{sink: "file:" + sinkPath})
+	if err != nil {
+		t.Fatalf("newForwarder failed: %s", err.Error())
+	}
+
+	deadLetter, err := NewLogWriter(deadLetterPath, OutputSettings{})
+	if err != nil {
+		t.Fatalf("NewLogWriter failed: %s", err.Error())
+	}
+
+	p := &pipeline{
+		msgs:            log.New(ioutil.Discard, "", 0),
+		errors:          newErrorSummary(),
+		errorWait:       time.Minute,
+		deadLetter:      deadLetter,
+		forwardRejected: true,
+		forwarder:       fwd,
+	}
+
+	p.reject("bad line\n", errors.New("Match not found"))
+	if p.errors.total != 1 {
+		t.Errorf("Rejected line wasn't counted")
+	}
+
+	<-fwd.client.Channel().Close()
+	sink, _ := ioutil.ReadFile(sinkPath)
+	if !strings.Contains(string(sink), `"message":"bad line"`) || !strings.Contains(string(sink), `"ParseError":"Match not found"`) {
+		t.Errorf("Unexpected telemetry: %s", sink)
+	}
+
+	// The dead letter output is written asynchronously
+	var data []byte
+	for i := 0; i < 100; i++ {
+		if data, _ = ioutil.ReadFile(deadLetterPath); len(data) > 0 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fields := strings.Split(strings.TrimRight(string(data), "\n"), "\t")
+	if len(fields) != 3 || fields[1] != "Match not found" || fields[2] != "bad line" {
+		t.Errorf("Unexpected dead letter output: %q", data)
+	}
+
+	deadLetter.Close()
+}
+
+// testConcurrentHandler parses lines like "<delay ms> <message>", taking
+// longer for some lines so that workers finish them out of order.
+type testConcurrentHandler struct{}
+
+func (handler *testConcurrentHandler) Initialize(*log.Logger, Tracker) error { return nil }
+
+func (handler *testConcurrentHandler) Receive(line string) error {
+	return errors.New("Receive shouldn't be called with workers")
+}
+
+func (handler *testConcurrentHandler) Parse(line string) (appinsights.Telemetry, error) {
+	fields := strings.SplitN(line, " ", 2)
+	delay, err := strconv.Atoi(fields[0])
+	if err != nil || len(fields) != 2 {
+		return nil, errors.New("Invalid line")
+	}
+
+	time.Sleep(time.Duration(delay) * time.Millisecond)
+	return appinsights.NewTraceTelemetry(fields[1], appinsights.Information), nil
+}
+
+func TestPipelineWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+	sinkPath := filepath.Join(dir, "telemetry.jsonl")
+
+	fwd, err := newForwarder(&options{sink: "file:" + sinkPath})
+	if err != nil {
+		t.Fatalf("newForwarder failed: %s", err.Error())
+	}
+
+	p := &pipeline{
+		msgs:       log.New(ioutil.Discard, "", 0),
+		handler:    &testConcurrentHandler{},
+		forwarder:  fwd,
+		logReader:  &LogReader{events: make(chan LogEventMessage)},
+		logWriter:  NewNilLogWriter(),
+		deadLetter: NewNilLogWriter(),
+		swap:       make(chan *pipeline),
+		resets:     make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+		errors:     newErrorSummary(),
+		errorWait:  time.Minute,
+		workers:    newWorkerPool(4),
+	}
+
+	done := make(chan *pipeline, 1)
+	go p.readLoop(done)
+
+	var expected []string
+	for i := 0; i < 50; i++ {
+		message := fmt.Sprintf("line %d", i)
+		expected = append(expected, message)
+		p.logReader.events <- LogEventMessage{data: fmt.Sprintf("%d %s", (50-i)%5, message)}
+		if i%10 == 0 {
+			p.logReader.events <- LogEventMessage{data: "bad"}
+		}
+	}
+
+	// Lines still being parsed when the input closes are tracked too
+	p.logReader.events <- LogEventMessage{closed: true}
+	<-done
+	if p.errors.total != 0 {
+		t.Errorf("Errors should have been reported when the pipeline stopped")
+	}
+
+	<-fwd.client.Channel().Close()
+	sink, _ := ioutil.ReadFile(sinkPath)
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(string(sink)), "\n") {
+		var envelope struct {
+			Data struct {
+				BaseData struct {
+					Message string `json:"message"`
+				} `json:"baseData"`
+			} `json:"data"`
+		}
+
+		if err := json.Unmarshal([]byte(line), &envelope); err != nil {
+			t.Fatalf("Invalid telemetry %q: %s", line, err.Error())
+		}
+
+		messages = append(messages, envelope.Data.BaseData.Message)
+	}
+
+	if strings.Join(messages, ",") != strings.Join(expected, ",") {
+		t.Errorf("Telemetry out of order:\n%v", messages)
+	}
+}
+
+func TestPipelinePartialLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+	sinkPath := filepath.Join(dir, "telemetry.jsonl")
+
+	fwd, err := newForwarder(&options{sink: "file:" + sinkPath})
+	if err != nil {
+		t.Fatalf("newForwarder failed: %s", err.Error())
+	}
+
+	// Partial lines are parsed by a ConcurrentHandler even without workers
+	p := &pipeline{
+		msgs:      log.New(ioutil.Discard, "", 0),
+		handler:   &testConcurrentHandler{},
+		forwarder: fwd,
+		errors:    newErrorSummary(),
+		errorWait: time.Minute,
+	}
+
+	p.receive("0 partial\n", true)
+	if p.errors.total != 0 {
+		t.Errorf("Partial line was rejected")
+	}
+
+	<-fwd.client.Channel().Close()
+	sink, _ := ioutil.ReadFile(sinkPath)
+	if !strings.Contains(string(sink), `"message":"partial\n"`) || !strings.Contains(string(sink), `"PartialLine":"true"`) {
+		t.Errorf("Unexpected telemetry: %s", sink)
+	}
+}
+
+func TestPipelineStuckOutput(t *testing.T) {
+	// An output that takes messages but never finishes writing, like a FIFO
+	// that nothing reads with -outblock
+	stuck := newLogWriter()
+	go func() {
+		for range stuck.control {
+		}
+	}()
+
+	reader := newTestLogReader()
+	p := &pipeline{
+		msgs:       log.New(ioutil.Discard, "", 0),
+		handler:    &testConcurrentHandler{},
+		errors:     newErrorSummary(),
+		logReader:  reader,
+		logWriter:  stuck,
+		deadLetter: NewNilLogWriter(),
+		flushWait:  50 * time.Millisecond,
+		swap:       make(chan *pipeline),
+		resets:     make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+	}
+
+	done := make(chan *pipeline, 1)
+	go p.readLoop(done)
+	reader.events <- LogEventMessage{closed: true}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pipeline didn't stop")
+	}
+}
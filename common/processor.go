@@ -0,0 +1,83 @@
+package common
+
+import (
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Item is telemetry on its way from a handler to the telemetry client.
+type Item struct {
+	Telemetry appinsights.Telemetry
+
+	// Percentage of telemetry that this item represents, set by sampling
+	SampleRate float64
+}
+
+// TelemetryProcessor is a step between the handlers and the telemetry
+// client.  Process may modify the item, and returns false to drop it.
+type TelemetryProcessor interface {
+	Process(item *Item) bool
+}
+
+// ProcessorFunc adapts an ordinary function to a TelemetryProcessor.
+type ProcessorFunc func(item *Item) bool
+
+func (f ProcessorFunc) Process(item *Item) bool {
+	return f(item)
+}
+
+// processorChain runs items through each of its processors in turn, and
+// stops if one drops it.
+type processorChain []TelemetryProcessor
+
+func (chain processorChain) Process(item *Item) bool {
+	for _, processor := range chain {
+		if !processor.Process(item) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// contextProcessor sets custom properties and role tags on telemetry unless
+// it already has them.
+type contextProcessor struct {
+	custom       customProperties
+	role         string
+	roleInstance string
+}
+
+func (p *contextProcessor) Process(item *Item) bool {
+	if props := item.Telemetry.GetProperties(); props != nil {
+		for k, v := range p.custom {
+			if _, ok := props[k]; !ok {
+				props[k] = v
+			}
+		}
+	}
+
+	if tags := contracts.ContextTags(item.Telemetry.ContextTags()); tags != nil {
+		if _, ok := tags[contracts.CloudRole]; !ok && p.role != "" {
+			tags.Cloud().SetRole(p.role)
+		}
+
+		if _, ok := tags[contracts.CloudRoleInstance]; !ok && p.roleInstance != "" {
+			tags.Cloud().SetRoleInstance(p.roleInstance)
+		}
+	}
+
+	return true
+}
+
+// samplingProcessor drops items that aren't selected by its sampler, and
+// records the sampling rate on the rest.
+type samplingProcessor struct {
+	sampler sampler
+}
+
+func (p *samplingProcessor) Process(item *Item) bool {
+	rate, keep := p.sampler.Sample(item.Telemetry)
+	item.SampleRate = rate
+	return keep
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+func TestProcessorChain(t *testing.T) {
+	var order []string
+	step := func(name string, keep bool) TelemetryProcessor {
+		return ProcessorFunc(func(item *Item) bool {
+			order = append(order, name)
+			return keep
+		})
+	}
+
+	item := &Item{Telemetry: appinsights.NewTraceTelemetry("test", appinsights.Information), SampleRate: 100}
+	chain := processorChain{step("a", true), step("b", false), step("c", true)}
+	if chain.Process(item) {
+		t.Error("Chain should drop the item")
+	}
+
+	if len(order) != 2 || order[0] != "a" || order[1] != "b" {
+		t.Errorf("Unexpected processor order: %v", order)
+	}
+}
+
+func TestContextProcessor(t *testing.T) {
+	processor := &contextProcessor{
+		custom:       customProperties{"env": "test", "kept": "no"},
+		role:         "web",
+		roleInstance: "web-1",
+	}
+
+	telem := appinsights.NewTraceTelemetry("test", appinsights.Information)
+	telem.Properties["kept"] = "yes"
+	telem.Tags.Cloud().SetRole("api")
+
+	processor.Process(&Item{Telemetry: telem})
+	if telem.Properties["env"] != "test" || telem.Properties["kept"] != "yes" {
+		t.Errorf("Unexpected properties: %v", telem.Properties)
+	}
+
+	if telem.Tags[contracts.CloudRole] != "api" || telem.Tags[contracts.CloudRoleInstance] != "web-1" {
+		t.Errorf("Unexpected tags: %v", telem.Tags)
+	}
+}
+
+func TestSamplingProcessor(t *testing.T) {
+	processor := &samplingProcessor{&fixedSampler{25}}
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		item := &Item{Telemetry: appinsights.NewTraceTelemetry("test", appinsights.Information), SampleRate: 100}
+		if processor.Process(item) {
+			kept++
+		}
+
+		if item.SampleRate != 25 {
+			t.Fatalf("Unexpected sample rate: %f", item.SampleRate)
+		}
+	}
+
+	if kept == 0 || kept == 1000 {
+		t.Errorf("Sampling kept %d of 1000 items", kept)
+	}
+}
@@ -2,23 +2,112 @@ package common
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 type LogReader struct {
 	events  chan LogEventMessage
 	control chan LogControlMessage
 	closed  bool
+	done    chan struct{}
+	limits  LineLimits
+	stats   *readerStats
+}
+
+// LineLimits says how a LogReader treats lines that are too long.
+type LineLimits struct {
+	// Longest line in bytes, not counting the newline, or 0 for no limit
+	MaxLength int
+
+	// Whether to split long lines into several instead of truncating them
+	Split bool
+
+	// How long a partial line may wait for the rest of it before it is sent
+	// anyway, or 0 to wait until the input closes
+	IdleFlush time.Duration
+}
+
+// Default for -maxline
+const defaultMaxLineLength = 1024 * 1024
+
+// longLineMode is a flag.Value for -longlines, which is true for split.
+type longLineMode bool
+
+func (mode *longLineMode) String() string {
+	if *mode {
+		return "split"
+	}
+
+	return "truncate"
+}
+
+func (mode *longLineMode) Set(value string) error {
+	switch value {
+	case "truncate":
+		*mode = false
+	case "split":
+		*mode = true
+	default:
+		return fmt.Errorf("Must be truncate or split")
+	}
+
+	return nil
+}
+
+// readerStats counts the lines that a LogReader had to change.  They are
+// counted on the reader's goroutines and reported from the pipeline's.
+type readerStats struct {
+	truncated   int64
+	split       int64
+	invalidUtf8 int64
+	nul         int64
+}
+
+// report writes the counts to msgs, if there were any, and resets them.  The
+// interval is only used in the message.
+func (stats *readerStats) report(msgs *log.Logger, interval time.Duration) {
+	if stats == nil {
+		return
+	}
+
+	counts := []struct {
+		count *int64
+		what  string
+	}{
+		{&stats.truncated, "truncated"},
+		{&stats.split, "split"},
+		{&stats.invalidUtf8, "with invalid UTF-8 replaced"},
+		{&stats.nul, "with NUL bytes removed"},
+	}
+
+	for _, c := range counts {
+		n := atomic.SwapInt64(c.count, 0)
+		if n == 0 {
+			continue
+		}
+
+		if interval > 0 {
+			msgs.Printf("%d lines %s in the last %s", n, c.what, interval)
+		} else {
+			msgs.Printf("%d lines %s", n, c.what)
+		}
+	}
 }
 
 type LogEventMessage struct {
-	data   string
-	closed bool
-	err    error
+	data    string
+	partial bool
+	closed  bool
+	err     error
 }
 
 type LogControlMessage struct {
@@ -27,22 +116,38 @@ type LogControlMessage struct {
 	shutdown bool
 }
 
+// Reset reopens the input, e.g. after it was rotated.
 func (logReader *LogReader) Reset() {
-	logReader.control <- LogControlMessage{reset: true}
+	logReader.send(LogControlMessage{reset: true})
 }
 
+// Close stops reading the input.  The rest of it is sent, followed by a
+// closed event.
 func (logReader *LogReader) Close() {
-	logReader.control <- LogControlMessage{close: true}
+	logReader.send(LogControlMessage{close: true})
+}
+
+func (logReader *LogReader) send(ctl LogControlMessage) {
+	select {
+	case logReader.control <- ctl:
+	case <-logReader.done:
+	}
 }
 
 func (logReader *LogReader) Events() chan LogEventMessage {
 	return logReader.events
 }
 
-func MakeLogReader(infile string) (*LogReader, error) {
-	events := make(chan LogEventMessage)
-	control := make(chan LogControlMessage)
-	result := &LogReader{events, control, false}
+// MakeLogReader reads lines from stdin ('-'), a named pipe or a regular file,
+// limiting their length and replacing bytes that can't be forwarded.
+func MakeLogReader(infile string, limits LineLimits) (*LogReader, error) {
+	result := &LogReader{
+		events:  make(chan LogEventMessage),
+		control: make(chan LogControlMessage),
+		done:    make(chan struct{}),
+		limits:  limits,
+		stats:   &readerStats{},
+	}
 
 	if infile == "-" {
 		// Stdin pipe
@@ -82,9 +187,7 @@ func MakeLogReader(infile string) (*LogReader, error) {
 }
 
 func readStdin(logReader *LogReader) error {
-	file := os.NewFile(0, "stdin")
-
-	stat, err := file.Stat()
+	stat, err := os.Stdin.Stat()
 	if err != nil {
 		return fmt.Errorf("Error stat'ing stdin: %s", err.Error())
 	}
@@ -93,160 +196,106 @@ func readStdin(logReader *LogReader) error {
 		return fmt.Errorf("Refusing to read data from a terminal")
 	}
 
-	// Data stream
-	go func() {
-		buf := make([]byte, 2048)
-		writer := makeLogEventWriter(logReader.events, 0)
-
-		for {
-			n, err := file.Read(buf)
-			if err == io.EOF || n == 0 {
-				break
-			}
-
-			if err != nil {
-				logReader.events <- LogEventMessage{err: fmt.Errorf("Error while reading stdin: %s", err.Error())}
-				break
-			}
-
-			writer.Write(buf[0:n])
+	// In nonblocking mode, a pipe or socket is read through the runtime's
+	// poller, and Close can interrupt a Read.  The mode belongs to the pipe
+	// rather than to us, so it's put back when we're done, and other kinds
+	// of input, like a redirected file, are left alone.
+	var restore func()
+	if (stat.Mode() & (os.ModeNamedPipe | os.ModeSocket)) != 0 {
+		if err := syscall.SetNonblock(0, true); err != nil {
+			return fmt.Errorf("Error setting stdin to nonblocking mode: %s", err.Error())
 		}
 
-		log.Print("Exiting read loop")
+		restore = func() { syscall.SetNonblock(0, false) }
+	}
 
-		file.Close()
-		logReader.closed = true
-		logReader.events <- LogEventMessage{closed: true}
-		logReader.control <- LogControlMessage{shutdown: true}
-	}()
+	readStream("stdin", os.NewFile(0, "stdin"), logReader, restore)
+	return nil
+}
+
+// readStream reads from an open pipe until it closes, or the reader is
+// closed.  Resets are ignored.  If restore is specified, it's called before
+// the file is closed.
+func readStream(name string, file *os.File, logReader *LogReader, restore func()) {
+	logReader.closed = false
 
-	// Control stream
 	go func() {
+		writer := makeLogEventWriter(logReader, logReader.events, 0)
+		stopped := readPipe(file, writer)
+
 		for {
 			select {
+			case err := <-stopped:
+				log.Print("Exiting read loop")
+				if restore != nil {
+					restore()
+				}
+
+				file.Close()
+				if err != nil {
+					err = fmt.Errorf("Error while reading %s: %s", name, err.Error())
+				}
+
+				logReader.finish(writer, err)
+				return
 			case ctl := <-logReader.control:
 				if ctl.close {
 					log.Print("Received close signal")
-					file.Close()
-				} else if ctl.shutdown {
-					return
+					interruptRead(file)
 				}
 			}
 		}
 	}()
-
-	return nil
 }
 
 func readFifo(infile string, logReader *LogReader) error {
-	file, err := os.OpenFile(infile, os.O_RDWR, 0)
+	file, err := openFifo(infile)
 	if err != nil {
 		return err
 	}
 
-	// FIFOs are tricky.  Here's how they end up working:
-	// If opened with O_RDONLY:
-	//   - Open blocks waiting for writer.
-	//   - File is closed when writer closes, Read is interrupted.
-	//   - Read cannot be interrupted by concurrent Close.
-	// If opened with O_RDWR (probably Linux-specific behavior):
-	//   - Open() does not block.
-	//   - File stays open when writer closes, can accept other
-	//     writers without reopening.
-	//   - Read still cannot be interrupted by concurrent Close.
-	// So we pick O_RDWR.  To signal the data goroutine to quit,
-	// we need to use a channel to signal interruption + write
-	// data to the pipe to get Read() to return.
-
 	logReader.closed = false
-	events := make(chan LogEventMessage)
-	interrupt := make(chan bool, 1)
 
-	// Data stream
 	go func() {
-		buf := make([]byte, 2048)
-		writer := makeLogEventWriter(events, 0)
+		writer := makeLogEventWriter(logReader, logReader.events, 0)
+		stopped := readPipe(file, writer)
 
-	wait:
 		for {
-			n, err := file.Read(buf)
-			if err == io.EOF || n == 0 {
-				break
-			}
-
-			if err != nil {
-				events <- LogEventMessage{err: fmt.Errorf("Error while reading %s: %s", infile, err.Error()), closed: true}
-				break
-			}
-
-			// Check for interrupt signal
 			select {
-			case <-interrupt:
+			case err := <-stopped:
+				log.Print("Exited FIFO loop")
 				file.Close()
-				break wait
-			default:
-				break
-			}
-
-			writer.Write(buf[0:n])
-		}
-
-		log.Print("Exited FIFO loop")
-
-		logReader.closed = true
-		events <- LogEventMessage{closed: true}
-		logReader.control <- LogControlMessage{shutdown: true}
-	}()
+				if err != nil {
+					err = fmt.Errorf("Error while reading %s: %s", infile, err.Error())
+				}
 
-	// Control stream
-	go func() {
-		for {
-			select {
-			case event := <-events:
-				// Forward event
-				logReader.events <- event
+				logReader.finish(writer, err)
+				return
 			case ctl := <-logReader.control:
 				if ctl.close {
-					interrupt <- true
-					file.WriteString("\n") // WAKE UP!
+					log.Print("Received close signal")
+					interruptRead(file)
 				} else if ctl.reset {
 					log.Print("Received reset signal")
-					interrupt <- true
-					file.WriteString("\n") // WAKE UP!
 
-					// Wait for close
-					for {
-						event := <-events
-						closed := event.closed
-						if event.data != "" {
-							logReader.events <- event
-						}
-
-						if closed {
-							break
-						}
-					}
-
-					// Wait for shutdown
-					for {
-						ctl := <-logReader.control
-						if ctl.shutdown {
-							break
-						}
-					}
-
-					log.Print("Re-entering readFifo")
-					// Re-open the file
-					err := readFifo(infile, logReader)
+					// Open the FIFO again before closing it, so that there's
+					// always a reader and nothing that writers have written
+					// is lost.  The writer carries over so that a line that
+					// was partly read continues where it left off.
+					next, err := openFifo(infile)
 					if err != nil {
-						// Oops
 						logReader.events <- LogEventMessage{err: fmt.Errorf("Error trying to reopen %s: %s", infile, err.Error())}
+						break
 					}
 
-					close(events)
-					return
-				} else if ctl.shutdown {
-					return
+					interruptRead(file)
+					if err := <-stopped; err != nil {
+						logReader.events <- LogEventMessage{err: fmt.Errorf("Error while reading %s: %s", infile, err.Error())}
+					}
+
+					file.Close()
+					file = next
+					stopped = readPipe(file, writer)
 				}
 			}
 		}
@@ -255,6 +304,62 @@ func readFifo(infile string, logReader *LogReader) error {
 	return nil
 }
 
+// openFifo opens a named pipe for reading.
+//
+// If opened with O_RDONLY, Open blocks until there is a writer, and Read
+// returns EOF once the last writer closes its end.  With O_RDWR (probably
+// Linux-specific behavior), Open doesn't block, and the FIFO stays open
+// between writers because we are one of them.  Either way, the runtime reads
+// it in nonblocking mode, so interruptRead works.
+func openFifo(infile string) (*os.File, error) {
+	return os.OpenFile(infile, os.O_RDWR, 0)
+}
+
+// readPipe reads from a pipe on another goroutine, passing the data to the
+// writer.  It returns a channel that receives the error that stopped it, or
+// nil if the pipe closed or the read was interrupted.
+func readPipe(file *os.File, writer *logEventWriter) chan error {
+	stopped := make(chan error, 1)
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := file.Read(buf)
+			if n > 0 {
+				writer.Write(buf[0:n])
+			}
+
+			if err == io.EOF || os.IsTimeout(err) || errors.Is(err, os.ErrClosed) {
+				stopped <- nil
+				return
+			} else if err != nil {
+				stopped <- err
+				return
+			}
+		}
+	}()
+
+	return stopped
+}
+
+// interruptRead makes a Read that is blocked on the file return.  Pipes
+// support deadlines, so one in the past wakes the reader without affecting
+// anything else that has the pipe open.  Other files are closed instead.
+func interruptRead(file *os.File) {
+	if err := file.SetReadDeadline(time.Now()); err != nil {
+		file.Close()
+	}
+}
+
+// finish sends the rest of the input and then the closed event, with the
+// error that stopped it, if any.  Afterwards, Reset and Close do nothing.
+func (logReader *LogReader) finish(writer *logEventWriter, err error) {
+	writer.Close()
+	logReader.closed = true
+	logReader.events <- LogEventMessage{err: err, closed: true}
+	close(logReader.done)
+}
+
 func readFile(infile string, logReader *LogReader) error {
 	file, err := os.OpenFile(infile, os.O_RDONLY, 0)
 	if err != nil {
@@ -296,7 +401,7 @@ func readFile(infile string, logReader *LogReader) error {
 			}
 		}
 
-		writer := makeLogEventWriter(events, skip)
+		writer := makeLogEventWriter(logReader, events, skip)
 
 		// Read data
 		for {
@@ -307,6 +412,7 @@ func readFile(infile string, logReader *LogReader) error {
 				continue
 			} else if err != nil {
 				log.Printf("Error during read was: %s", err.Error())
+				writer.Close()
 				file.Close()
 				logReader.closed = true
 				events <- LogEventMessage{err: fmt.Errorf("Error while reading %s: %s", infile, err.Error()), closed: true}
@@ -359,12 +465,14 @@ func readFile(infile string, logReader *LogReader) error {
 					err := readFile(infile, logReader)
 					if err != nil {
 						logReader.events <- LogEventMessage{err: fmt.Errorf("Error trying to reopen %s: %s", infile, err.Error()), closed: true}
+						close(logReader.done)
 					}
 
 					return
 				}
 
 				if ctl.shutdown {
+					close(logReader.done)
 					return
 				}
 			}
@@ -374,39 +482,219 @@ func readFile(infile string, logReader *LogReader) error {
 	return nil
 }
 
+// logEventWriter splits data into lines and sends them as events.  Lines
+// are limited to the reader's maximum length, and have NUL bytes removed and
+// invalid UTF-8 replaced.  A partial line at the end is sent when the writer
+// is closed, or after it has been idle for a while.
 type logEventWriter struct {
+	lock   sync.Mutex
 	buffer bytes.Buffer
 	events chan LogEventMessage
 	skip   int
+	limits LineLimits
+	stats  *readerStats
+	closed bool
+
+	// Whether the rest of the current line is being dropped, or has been
+	// split
+	discard bool
+	split   bool
+
+	// Timer to send a partial line, and the number of writes so far so that
+	// it doesn't send one that has changed since it was set
+	idle   *time.Timer
+	writes int
 }
 
-func makeLogEventWriter(events chan LogEventMessage, skip int) *logEventWriter {
-	return &logEventWriter{events: events, skip: skip}
+func makeLogEventWriter(logReader *LogReader, events chan LogEventMessage, skip int) *logEventWriter {
+	return &logEventWriter{
+		events: events,
+		skip:   skip,
+		limits: logReader.limits,
+		stats:  logReader.stats,
+	}
 }
 
 func (writer *logEventWriter) Write(data []byte) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	defer writer.startIdle()
+
 	for len(data) > 0 {
-		idx := bytes.IndexByte(data, '\n')
-		if idx < 0 {
-			if writer.skip == 0 {
-				writer.buffer.Write(data)
-			}
-			return
+		line := data
+		complete := false
+		if idx := bytes.IndexByte(data, '\n'); idx >= 0 {
+			line = data[0:idx]
+			data = data[idx+1:]
+			complete = true
 		} else {
-			if writer.skip == 0 {
-				if writer.buffer.Len() == 0 {
-					// Skip writing intermediate to buffer
-					writer.events <- LogEventMessage{data: string(data[0 : idx+1])}
-				} else {
-					writer.buffer.Write(data[0 : idx+1])
-					writer.events <- LogEventMessage{data: writer.buffer.String()}
-					writer.buffer.Reset()
+			data = nil
+		}
+
+		if writer.skip > 0 {
+			if complete {
+				writer.skip -= 1
+			}
+
+			continue
+		}
+
+		writer.add(line, complete)
+	}
+}
+
+// add appends part of a line, sending it if the line is complete or too
+// long.
+func (writer *logEventWriter) add(line []byte, complete bool) {
+	for !writer.discard {
+		room := writer.limits.MaxLength - writer.buffer.Len()
+		if writer.limits.MaxLength <= 0 || len(line) <= room {
+			if !complete {
+				writer.buffer.Write(line)
+			} else if writer.buffer.Len() == 0 {
+				// Skip writing intermediate to buffer
+				if len(line) > 0 || !writer.split {
+					writer.send(line)
 				}
+
+				writer.split = false
 			} else {
-				writer.skip -= 1
+				writer.buffer.Write(line)
+				writer.send(writer.buffer.Bytes())
+				writer.buffer.Reset()
+				writer.split = false
+			}
+
+			return
+		}
+
+		// Too long: send as much as fits without cutting a character in
+		// two, then split or drop the rest
+		cut := room - writer.runeBackoff(line, room)
+		if cut >= 0 {
+			writer.buffer.Write(line[0:cut])
+			writer.send(writer.buffer.Bytes())
+			writer.buffer.Reset()
+			line = line[cut:]
+		} else {
+			// The character started in the buffer
+			buf := writer.buffer.Bytes()
+			carry := string(buf[len(buf)+cut:])
+			writer.send(buf[:len(buf)+cut])
+			writer.buffer.Reset()
+			if writer.limits.Split {
+				writer.buffer.WriteString(carry)
+			}
+		}
+
+		if writer.limits.Split {
+			if !writer.split {
+				atomic.AddInt64(&writer.stats.split, 1)
+				writer.split = true
 			}
+		} else {
+			atomic.AddInt64(&writer.stats.truncated, 1)
+			writer.discard = true
+		}
+	}
+
+	if complete {
+		writer.discard = false
+	}
+}
+
+// runeBackoff returns how many bytes to leave off the end of the buffer
+// followed by line[:room] so that the character at the cut isn't split.
+// It returns 0 if the data isn't valid UTF-8 there, or if the character is
+// longer than the limit.
+func (writer *logEventWriter) runeBackoff(line []byte, room int) int {
+	buf := writer.buffer.Bytes()
+	at := func(i int) byte {
+		if i < len(buf) {
+			return buf[i]
+		}
+
+		return line[i-len(buf)]
+	}
+
+	end := len(buf) + room
+	if utf8.RuneStart(at(end)) {
+		return 0
+	}
+
+	// Look back for the first byte of a multi-byte character
+	for n := 1; n < utf8.UTFMax && n < end; n++ {
+		if b := at(end - n); b >= 0xc0 {
+			return n
+		} else if utf8.RuneStart(b) {
+			break
+		}
+	}
+
+	return 0
+}
+
+// Close sends the partial line, if there is one, and stops the writer.
+func (writer *logEventWriter) Close() {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	if writer.idle != nil {
+		writer.idle.Stop()
+	}
+
+	writer.flush()
+	writer.closed = true
+}
+
+// startIdle sets a timer to send the partial line if no more data arrives
+// for it in time.
+func (writer *logEventWriter) startIdle() {
+	writer.writes++
+	if writer.limits.IdleFlush <= 0 || writer.buffer.Len() == 0 {
+		return
+	}
 
-			data = data[idx+1 : len(data)]
+	if writer.idle != nil {
+		writer.idle.Stop()
+	}
+
+	writes := writer.writes
+	writer.idle = time.AfterFunc(writer.limits.IdleFlush, func() {
+		writer.lock.Lock()
+		defer writer.lock.Unlock()
+
+		if writer.writes == writes && !writer.closed {
+			writer.flush()
 		}
+	})
+}
+
+// flush sends the partial line, if there is one.  The rest of the line, if
+// it arrives later, is sent as another line.  The buffer is empty while the
+// rest of a truncated line is being dropped, so nothing is sent then.
+func (writer *logEventWriter) flush() {
+	if writer.buffer.Len() > 0 {
+		writer.sendPartial(writer.buffer.Bytes(), true)
+		writer.buffer.Reset()
 	}
 }
+
+// send sends a line, without its newline, as an event.
+func (writer *logEventWriter) send(line []byte) {
+	writer.sendPartial(line, false)
+}
+
+func (writer *logEventWriter) sendPartial(line []byte, partial bool) {
+	if bytes.IndexByte(line, 0) >= 0 {
+		line = bytes.Replace(line, []byte{0}, nil, -1)
+		atomic.AddInt64(&writer.stats.nul, 1)
+	}
+
+	if !utf8.Valid(line) {
+		line = bytes.ToValidUTF8(line, []byte(string(utf8.RuneError)))
+		atomic.AddInt64(&writer.stats.invalidUtf8, 1)
+	}
+
+	writer.events <- LogEventMessage{data: string(line) + "\n", partial: partial}
+}
@@ -0,0 +1,292 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeLines passes the chunks to a logEventWriter and returns the lines it
+// sends.
+func writeLines(limits LineLimits, skip int, chunks ...string) ([]string, *readerStats) {
+	events := make(chan LogEventMessage, 100)
+	reader := &LogReader{limits: limits, stats: &readerStats{}}
+	writer := makeLogEventWriter(reader, events, skip)
+	for _, chunk := range chunks {
+		writer.Write([]byte(chunk))
+	}
+
+	close(events)
+	var lines []string
+	for event := range events {
+		lines = append(lines, event.data)
+	}
+
+	return lines, reader.stats
+}
+
+func expectLines(t *testing.T, actual []string, expected ...string) {
+	if strings.Join(actual, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected lines %q, got %q", expected, actual)
+	}
+}
+
+func TestLogEventWriter(t *testing.T) {
+	lines, _ := writeLines(LineLimits{}, 0, "a\nb", "c\n\nd")
+	expectLines(t, lines, "a\n", "bc\n", "\n")
+
+	lines, _ = writeLines(LineLimits{}, 1, "partial\nwhole\n")
+	expectLines(t, lines, "whole\n")
+}
+
+func TestLogEventWriterTruncate(t *testing.T) {
+	lines, stats := writeLines(LineLimits{MaxLength: 4}, 0, "abcdefgh\n12", "34", "56\nxyz\n")
+	expectLines(t, lines, "abcd\n", "1234\n", "xyz\n")
+	if stats.truncated != 2 || stats.split != 0 {
+		t.Errorf("Unexpected counts: %+v", *stats)
+	}
+
+	// Exactly the maximum length isn't truncated
+	lines, stats = writeLines(LineLimits{MaxLength: 4}, 0, "ab", "cd\n")
+	expectLines(t, lines, "abcd\n")
+	if stats.truncated != 0 {
+		t.Errorf("Unexpected counts: %+v", *stats)
+	}
+}
+
+func TestLogEventWriterSplit(t *testing.T) {
+	lines, stats := writeLines(LineLimits{MaxLength: 4, Split: true}, 0, "abcdefghij\n12", "345678\nxyz\n")
+	expectLines(t, lines, "abcd\n", "efgh\n", "ij\n", "1234\n", "5678\n", "xyz\n")
+	if stats.split != 2 || stats.truncated != 0 {
+		t.Errorf("Unexpected counts: %+v", *stats)
+	}
+
+	// Characters aren't cut in two, even when they arrive in pieces
+	limits := LineLimits{MaxLength: 4, Split: true}
+	for _, chunks := range [][]string{
+		{"abc\xc3\xa9fg\n"},
+		{"abc\xc3", "\xa9fg\n"},
+		{"ab", "c\xc3\xa9fg\n"},
+	} {
+		lines, stats := writeLines(limits, 0, chunks...)
+		expectLines(t, lines, "abc\n", "\u00e9fg\n")
+		if stats.split != 1 || stats.invalidUtf8 != 0 {
+			t.Errorf("Unexpected counts for %q: %+v", chunks, *stats)
+		}
+	}
+
+	// Truncating drops the whole character
+	lines, stats = writeLines(LineLimits{MaxLength: 4}, 0, "abc\xc3", "\xa9fg\n", "xyz\n")
+	expectLines(t, lines, "abc\n", "xyz\n")
+	if stats.truncated != 1 || stats.invalidUtf8 != 0 {
+		t.Errorf("Unexpected counts: %+v", *stats)
+	}
+
+	// Characters longer than the limit, and invalid data, are still cut
+	lines, _ = writeLines(LineLimits{MaxLength: 1, Split: true}, 0, "\xc3\xa9\n")
+	expectLines(t, lines, "\uFFFD\n", "\uFFFD\n")
+	lines, _ = writeLines(LineLimits{MaxLength: 2, Split: true}, 0, "a\x80\x80\x80\n")
+	expectLines(t, lines, "a\uFFFD\n", "\uFFFD\n")
+}
+
+func TestLogEventWriterSanitize(t *testing.T) {
+	lines, stats := writeLines(LineLimits{}, 0, "a\x00b\n", "caf\xe9\n", "ok\n")
+	expectLines(t, lines, "ab\n", "caf\uFFFD\n", "ok\n")
+	if stats.nul != 1 || stats.invalidUtf8 != 1 {
+		t.Errorf("Unexpected counts: %+v", *stats)
+	}
+}
+
+func TestLogEventWriterClose(t *testing.T) {
+	events := make(chan LogEventMessage, 100)
+	reader := &LogReader{stats: &readerStats{}}
+	writer := makeLogEventWriter(reader, events, 0)
+	writer.Write([]byte("a\nlast"))
+	writer.Close()
+	close(events)
+
+	var lines []string
+	for event := range events {
+		lines = append(lines, event.data)
+		if event.partial != (event.data == "last\n") {
+			t.Errorf("Unexpected partial flag on %q", event.data)
+		}
+	}
+
+	expectLines(t, lines, "a\n", "last\n")
+}
+
+func TestLogEventWriterIdleFlush(t *testing.T) {
+	events := make(chan LogEventMessage, 100)
+	reader := &LogReader{limits: LineLimits{IdleFlush: 20 * time.Millisecond}, stats: &readerStats{}}
+	writer := makeLogEventWriter(reader, events, 0)
+
+	// More data before the timeout delays it
+	writer.Write([]byte("ab"))
+	time.Sleep(5 * time.Millisecond)
+	writer.Write([]byte("c"))
+
+	select {
+	case event := <-events:
+		if event.data != "abc\n" || !event.partial {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Partial line wasn't flushed")
+	}
+
+	// The rest of the line is sent separately, and nothing is left to close
+	writer.Write([]byte("def\n"))
+	writer.Close()
+	close(events)
+
+	var lines []string
+	for event := range events {
+		lines = append(lines, event.data)
+	}
+
+	expectLines(t, lines, "def\n")
+}
+
+func newTestLogReader() *LogReader {
+	return &LogReader{
+		events:  make(chan LogEventMessage),
+		control: make(chan LogControlMessage),
+		done:    make(chan struct{}),
+		stats:   &readerStats{},
+	}
+}
+
+// nextEvent returns the reader's next event, or fails if there isn't one
+// soon.
+func nextEvent(t *testing.T, reader *LogReader) LogEventMessage {
+	select {
+	case event := <-reader.events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return LogEventMessage{}
+	}
+}
+
+func TestReadStreamClose(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %s", err.Error())
+	}
+
+	defer w.Close()
+	reader := newTestLogReader()
+	restored := false
+	readStream("test", r, reader, func() {
+		// The file is still open
+		if _, err := r.Stat(); err != nil {
+			t.Errorf("File closed before restore: %s", err.Error())
+		}
+
+		restored = true
+	})
+
+	w.Write([]byte("a\npart"))
+	if event := nextEvent(t, reader); event.data != "a\n" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	// Close interrupts the read even though the pipe is still open
+	go reader.Close()
+	if event := nextEvent(t, reader); event.data != "part\n" || !event.partial {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	if event := nextEvent(t, reader); !event.closed || event.err != nil {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	if !restored {
+		t.Error("Restore wasn't called")
+	}
+
+	// Once it's closed, these don't block
+	reader.Reset()
+	reader.Close()
+}
+
+func TestReadFifoReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reader")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatalf("Failed to create FIFO: %s", err.Error())
+	}
+
+	reader, err := MakeLogReader(path, LineLimits{})
+	if err != nil {
+		t.Fatalf("MakeLogReader failed: %s", err.Error())
+	}
+
+	// Several writers write lines, some of them in pieces, while the reader
+	// is reset
+	const writers, lines = 4, 200
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			fifo, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				t.Errorf("Failed to open FIFO: %s", err.Error())
+				return
+			}
+
+			defer fifo.Close()
+			for j := 0; j < lines; j++ {
+				fmt.Fprintf(fifo, "%d %d\n", id, j)
+				if j%20 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(i)
+	}
+
+	resets := make(chan struct{})
+	go func() {
+		defer close(resets)
+		for i := 0; i < 20; i++ {
+			reader.Reset()
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+
+	next := make([]int, writers)
+	for received := 0; received < writers*lines; received++ {
+		event := nextEvent(t, reader)
+		var id, j int
+		if _, err := fmt.Sscanf(event.data, "%d %d\n", &id, &j); err != nil || event.partial || id < 0 || id >= writers {
+			t.Fatalf("Unexpected event: %+v", event)
+		}
+
+		if j != next[id] {
+			t.Fatalf("Expected line %d from writer %d, got %d", next[id], id, j)
+		}
+
+		next[id]++
+	}
+
+	wg.Wait()
+	<-resets
+
+	go reader.Close()
+	if event := nextEvent(t, reader); !event.closed || event.err != nil {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
@@ -0,0 +1,161 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+const (
+	redactedValue = "REDACTED"
+
+	ipModeNone     = ""
+	ipModeTruncate = "truncate"
+	ipModeHash     = "hash"
+	ipModeDrop     = "drop"
+
+	// Property that holds the hashed client IP, since the IP tag has to be
+	// an address
+	ipHashProperty = "ClientIP.Hash"
+)
+
+// redactor removes personal data from telemetry before it is sent.
+type redactor struct {
+	params    *regexp.Regexp
+	scrub     RegexpList
+	ipMode    string
+	hashUsers bool
+	salt      string
+}
+
+func newRedactor(params []string, scrub RegexpList, ipMode string, hashUsers bool, salt string) (*redactor, error) {
+	switch ipMode {
+	case ipModeNone, ipModeTruncate, ipModeHash, ipModeDrop:
+	default:
+		return nil, fmt.Errorf("Invalid IP anonymization mode, must be one of: truncate, hash, drop")
+	}
+
+	if len(params) == 0 && len(scrub) == 0 && ipMode == ipModeNone && !hashUsers {
+		return nil, nil
+	}
+
+	result := &redactor{
+		scrub:     scrub,
+		ipMode:    ipMode,
+		hashUsers: hashUsers,
+		salt:      salt,
+	}
+
+	if len(params) > 0 {
+		quoted := make([]string, len(params))
+		for i, p := range params {
+			quoted[i] = regexp.QuoteMeta(p)
+		}
+
+		// Matches "name=" after a query separator; the value is everything up to
+		// the next separator.
+		result.params = regexp.MustCompile(fmt.Sprintf(`(?i)([?&;](?:%s)=)[^&;#\s"]*`, strings.Join(quoted, "|")))
+	}
+
+	return result, nil
+}
+
+func (r *redactor) Process(item *Item) bool {
+	r.Redact(item.Telemetry)
+	return true
+}
+
+// Redact modifies the telemetry item in place.
+func (r *redactor) Redact(t appinsights.Telemetry) {
+	switch item := t.(type) {
+	case *appinsights.RequestTelemetry:
+		item.Name = r.redactString(item.Name)
+		item.Url = r.redactString(item.Url)
+	case *appinsights.RemoteDependencyTelemetry:
+		item.Name = r.redactString(item.Name)
+		item.Data = r.redactString(item.Data)
+	case *appinsights.TraceTelemetry:
+		item.Message = r.redactString(item.Message)
+	case *appinsights.EventTelemetry:
+		item.Name = r.redactString(item.Name)
+	}
+
+	props := t.GetProperties()
+	for k, v := range props {
+		props[k] = r.redactString(v)
+	}
+
+	if tags := contracts.ContextTags(t.ContextTags()); tags != nil {
+		if name, ok := tags[contracts.OperationName]; ok {
+			tags.Operation().SetName(r.redactString(name))
+		}
+
+		if ip, ok := tags[contracts.LocationIp]; ok {
+			switch r.ipMode {
+			case ipModeTruncate:
+				if truncated := truncateIp(ip); truncated != "" {
+					tags.Location().SetIp(truncated)
+				} else {
+					delete(tags, contracts.LocationIp)
+				}
+			case ipModeHash:
+				if props != nil {
+					props[ipHashProperty] = r.hash(ip)
+				}
+
+				delete(tags, contracts.LocationIp)
+			case ipModeDrop:
+				delete(tags, contracts.LocationIp)
+			}
+		}
+
+		if r.hashUsers {
+			for _, key := range []string{contracts.UserId, contracts.UserAuthUserId, contracts.UserAccountId} {
+				if user, ok := tags[key]; ok && user != "" {
+					tags[key] = r.hash(user)
+				}
+			}
+		}
+	}
+}
+
+func (r *redactor) redactString(value string) string {
+	if r.params != nil {
+		value = r.params.ReplaceAllString(value, "${1}"+redactedValue)
+	}
+
+	for _, re := range r.scrub {
+		value = re.ReplaceAllLiteralString(value, redactedValue)
+	}
+
+	return value
+}
+
+func (r *redactor) hash(value string) string {
+	h := sha256.New()
+	h.Write([]byte(r.salt))
+	h.Write([]byte(value))
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// truncateIp zeroes the host part of an address: the last octet of IPv4
+// addresses, or everything past the /48 prefix for IPv6.  Returns an empty
+// string if it isn't an IP address.
+func truncateIp(ip string) string {
+	addr := net.ParseIP(strings.TrimSpace(ip))
+	if addr == nil {
+		return ""
+	}
+
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+func TestRedactQueryParams(t *testing.T) {
+	r, err := newRedactor([]string{"token", "password"}, nil, "", false, "")
+	if err != nil {
+		t.Fatalf("newRedactor failed: %s", err.Error())
+	}
+
+	request := appinsights.NewRequestTelemetry("GET", "http://localhost/login?user=me&Password=hunter2&token=abc;x=1", 0, "200")
+	request.Properties["http_referer"] = "http://localhost/?token=xyz"
+	r.Redact(request)
+
+	if request.Url != "http://localhost/login?user=me&Password=REDACTED&token=REDACTED;x=1" {
+		t.Errorf("Unexpected URL: %s", request.Url)
+	}
+
+	if request.Properties["http_referer"] != "http://localhost/?token=REDACTED" {
+		t.Errorf("Unexpected referer: %s", request.Properties["http_referer"])
+	}
+}
+
+func TestRedactScrub(t *testing.T) {
+	r, err := newRedactor(nil, RegexpList{regexp.MustCompile(`[a-z]+@example\.com`)}, "", false, "")
+	if err != nil {
+		t.Fatalf("newRedactor failed: %s", err.Error())
+	}
+
+	trace := appinsights.NewTraceTelemetry("Login from jdoe@example.com failed", appinsights.Warning)
+	trace.Properties["user"] = "jdoe@example.com"
+	r.Redact(trace)
+
+	if trace.Message != "Login from REDACTED failed" {
+		t.Errorf("Unexpected message: %s", trace.Message)
+	}
+
+	if trace.Properties["user"] != "REDACTED" {
+		t.Errorf("Unexpected property: %s", trace.Properties["user"])
+	}
+}
+
+func TestRedactIdentities(t *testing.T) {
+	r, err := newRedactor(nil, nil, "truncate", true, "salt")
+	if err != nil {
+		t.Fatalf("newRedactor failed: %s", err.Error())
+	}
+
+	request := appinsights.NewRequestTelemetry("GET", "http://localhost/", 0, "200")
+	request.Tags.Location().SetIp("192.168.1.57")
+	request.Tags.User().SetAuthUserId("jdoe")
+	r.Redact(request)
+
+	if ip := request.Tags.Location().GetIp(); ip != "192.168.1.0" {
+		t.Errorf("Unexpected IP: %s", ip)
+	}
+
+	if user := request.Tags.User().GetAuthUserId(); user == "jdoe" || user != r.hash("jdoe") {
+		t.Errorf("Unexpected user ID: %s", user)
+	}
+
+	if ip := truncateIp("2001:db8:1234:5678::1"); ip != "2001:db8:1234::" {
+		t.Errorf("Unexpected IPv6 truncation: %s", ip)
+	}
+
+	// Hashes aren't addresses, so they go in a property instead
+	r, _ = newRedactor(nil, nil, "hash", false, "salt")
+	request = appinsights.NewRequestTelemetry("GET", "http://localhost/", 0, "200")
+	request.Tags.Location().SetIp("192.168.1.57")
+	r.Redact(request)
+
+	if _, ok := request.Tags[contracts.LocationIp]; ok {
+		t.Errorf("Hashed IP left in the tag: %s", request.Tags.Location().GetIp())
+	}
+
+	if hash := request.Properties[ipHashProperty]; hash != r.hash("192.168.1.57") {
+		t.Errorf("Unexpected IP hash: %s", hash)
+	}
+
+	if _, err := newRedactor(nil, nil, "scramble", false, ""); err == nil {
+		t.Error("Should not accept invalid IP mode")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package common
 
 import (
 	"bytes"
@@ -6,9 +6,10 @@ import (
 	"regexp"
 )
 
-type regexpList []*regexp.Regexp
+// RegexpList is a flag.Value that collects regular expressions.
+type RegexpList []*regexp.Regexp
 
-func (lst *regexpList) String() string {
+func (lst *RegexpList) String() string {
 	if len(*lst) == 0 {
 		return ""
 	}
@@ -18,13 +19,13 @@ func (lst *regexpList) String() string {
 		if buf.Len() > 0 {
 			buf.WriteString(", ")
 		}
-		fmt.Fprintf(&buf, "\"%q\"", *r)
+		fmt.Fprintf(&buf, "%q", r.String())
 	}
 
 	return buf.String()
 }
 
-func (lst *regexpList) Set(value string) error {
+func (lst *RegexpList) Set(value string) error {
 	r, err := regexp.Compile(value)
 	if err != nil {
 		return err
@@ -34,7 +35,7 @@ func (lst *regexpList) Set(value string) error {
 	return nil
 }
 
-func (lst *regexpList) MatchAny(line string, dflt bool) bool {
+func (lst *RegexpList) MatchAny(line string, dflt bool) bool {
 	if len(*lst) == 0 {
 		return dflt
 	}
@@ -0,0 +1,16 @@
+package common
+
+import "testing"
+
+func TestRegexpListString(t *testing.T) {
+	var lst RegexpList
+	if lst.String() != "" {
+		t.Errorf("Expected an empty list to be empty, got %s", lst.String())
+	}
+
+	lst.Set(`^/health`)
+	lst.Set(`a"b`)
+	if expected := `"^/health", "a\"b"`; lst.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, lst.String())
+	}
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]HandlerFactory)
+)
+
+// RegisterHandler makes a kind of log handler available by name to
+// RunMultiple through Handlers.  It's meant to be called from the init
+// function of the package that implements the handler; the factory
+// registers the handler's options, which are then accepted on the command
+// line and in the configuration file.  Registering the same name twice
+// panics.
+func RegisterHandler(name string, factory HandlerFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("RegisterHandler: factory is nil")
+	}
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("RegisterHandler: handler %q registered twice", name))
+	}
+
+	registry[name] = factory
+}
+
+// Handlers returns the registered handlers, by name.
+func Handlers() map[string]HandlerFactory {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	result := make(map[string]HandlerFactory)
+	for name, factory := range registry {
+		result[name] = factory
+	}
+
+	return result
+}
+
+// argValue finds the value of the named option in args.  It's used for the
+// options needed before the command line can be parsed, since the handler
+// has to register its own options first.
+func argValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		} else if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return ""
+}
+
+// handlerName finds the handler selected for -in on the command line, in the
+// configuration file, or in the environment, in that order of precedence.
+func handlerName(args []string) (string, error) {
+	if name := argValue(args, "handler"); name != "" {
+		return name, nil
+	}
+
+	path := argValue(args, "config")
+	if path == "" {
+		path = os.Getenv(envName("config"))
+	}
+
+	if path != "" {
+		config, err := loadConfig(path)
+		if err != nil {
+			return "", fmt.Errorf("Error loading configuration: %s", err.Error())
+		}
+
+		if name, ok := config.values["handler"]; ok {
+			return expandEnv(fmt.Sprint(name)), nil
+		}
+	}
+
+	return os.Getenv(envName("handler")), nil
+}
+
+var processorRegistry []TelemetryProcessor
+
+// RegisterProcessor adds a processor that runs on telemetry from every
+// pipeline, after custom properties and roles are set and before sampling
+// and redaction.  Like RegisterHandler, it's meant to be called from an init
+// function.
+func RegisterProcessor(processor TelemetryProcessor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	processorRegistry = append(processorRegistry, processor)
+}
+
+func registeredProcessors() []TelemetryProcessor {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	return append([]TelemetryProcessor(nil), processorRegistry...)
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestArgValue(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-handler", "nginx"}, "nginx"},
+		{[]string{"--handler=trace", "-in", "-"}, "trace"},
+		{[]string{"-in", "handler", "-handler", "nginx"}, "nginx"},
+		{[]string{"-in", "-", "--", "-handler", "nginx"}, ""},
+		{[]string{"-handlers", "nginx"}, ""},
+		{[]string{"-handler"}, ""},
+	}
+
+	for _, test := range tests {
+		if result := argValue(test.args, "handler"); result != test.expected {
+			t.Errorf("argValue(%q): expected %q, got %q", test.args, test.expected, result)
+		}
+	}
+}
+
+func TestLoadHandler(t *testing.T) {
+	factories := map[string]HandlerFactory{"test": newTestConfigHandler}
+
+	path := writeTestConfig(t, "ikey: test\nhandler: test\nformat: $status\n")
+	ldr := &loader{args: []string{"-config", path, "-in", "-"}, factories: factories}
+	_, pipelines, err := ldr.load(flag.NewFlagSet("test", flag.ContinueOnError))
+	if err != nil {
+		t.Fatalf("load failed: %s", err.Error())
+	}
+
+	if len(pipelines) != 1 || pipelines[0].handler.(*testConfigHandler).format != "$status" {
+		t.Errorf("Unexpected pipelines: %+v", pipelines)
+	}
+
+	for _, args := range [][]string{
+		{"-ikey", "test", "-in", "-"},
+		{"-ikey", "test", "-in", "-", "-handler", "bogus"},
+	} {
+		ldr := &loader{args: args, factories: factories}
+		if _, _, err := ldr.load(flag.NewFlagSet("test", flag.ContinueOnError)); err == nil {
+			t.Errorf("load should fail for %q", args)
+		}
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	RegisterHandler("registrytest", newTestConfigHandler)
+	if Handlers()["registrytest"] == nil {
+		t.Fatal("Handler wasn't registered")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a handler twice should panic")
+		}
+	}()
+
+	RegisterHandler("registrytest", newTestConfigHandler)
+}
@@ -0,0 +1,300 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix of rotated files, which sorts in the order they were rotated
+const rotateTimeFormat = "20060102T150405.000000"
+
+// rotatingFile is an output file that is renamed aside and replaced when it
+// gets too big or has been written for too long.  Rotated files are named
+// after the time they were rotated, optionally compressed, and the oldest
+// are removed.  A writer that isn't blocking closes its file from another
+// goroutine to stop, so Close may be called during a Write.
+type rotatingFile struct {
+	path     string
+	settings OutputSettings
+
+	lock    sync.Mutex
+	file    io.WriteCloser
+	size    int64
+	opened  time.Time
+	rotated time.Time
+	closed  bool
+
+	// Rotated files being compressed
+	compressing sync.WaitGroup
+
+	// Held while compressing or pruning, so that prune never sees a file
+	// that is half way through compression
+	maintenance sync.Mutex
+}
+
+// openRotatingFile opens the file for appending.  Rotation only applies to
+// regular files, so anything else, like a FIFO, is opened as-is.
+func openRotatingFile(path string, settings OutputSettings) (io.WriteCloser, error) {
+	file, err := openLogOut(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil || !stat.Mode().IsRegular() {
+		return file, nil
+	}
+
+	return &rotatingFile{
+		path:     path,
+		settings: settings,
+		file:     file,
+		size:     stat.Size(),
+		opened:   time.Now(),
+	}, nil
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.due(len(data)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file and waits for rotated files to be compressed.
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return os.ErrClosed
+	}
+
+	f.closed = true
+	err := f.file.Close()
+	f.lock.Unlock()
+
+	f.compressing.Wait()
+	return err
+}
+
+// due returns whether the file should be rotated before writing n more
+// bytes.  An empty file is never rotated.
+func (f *rotatingFile) due(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+
+	if f.settings.MaxSize > 0 && f.size+int64(n) > f.settings.MaxSize {
+		return true
+	}
+
+	return f.settings.MaxAge > 0 && time.Since(f.opened) >= f.settings.MaxAge
+}
+
+// rotate renames the file aside and opens a new one in its place.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	// Names have to sort in the order the files were rotated, even if the
+	// clock doesn't move between rotations
+	now := time.Now().UTC()
+	if !now.After(f.rotated) {
+		now = f.rotated.Add(time.Microsecond)
+	}
+
+	rotated := fmt.Sprintf("%s.%s", f.path, now.Format(rotateTimeFormat))
+	for fileExists(rotated) || fileExists(rotated+".gz") {
+		now = now.Add(time.Microsecond)
+		rotated = fmt.Sprintf("%s.%s", f.path, now.Format(rotateTimeFormat))
+	}
+
+	f.rotated = now
+
+	if err := os.Rename(f.path, rotated); err != nil {
+		return fmt.Errorf("Error rotating %s: %s", f.path, err.Error())
+	}
+
+	file, err := openLogOut(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.file = file
+	f.size = 0
+	f.opened = time.Now()
+
+	if f.settings.Compress {
+		f.compressing.Add(1)
+		go func() {
+			defer f.compressing.Done()
+			f.maintenance.Lock()
+			err := compressFile(rotated)
+			f.maintenance.Unlock()
+
+			// It may already have been pruned
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Error compressing %s: %s", rotated, err.Error())
+			}
+
+			f.prune()
+		}()
+	} else {
+		f.prune()
+	}
+
+	return nil
+}
+
+// prune removes the oldest rotated files beyond the number to keep.
+func (f *rotatingFile) prune() {
+	if f.settings.Keep <= 0 {
+		return
+	}
+
+	f.maintenance.Lock()
+	defer f.maintenance.Unlock()
+
+	rotated, err := rotatedFiles(f.path)
+	if err != nil {
+		log.Printf("Error listing rotated files of %s: %s", f.path, err.Error())
+		return
+	}
+
+	for len(rotated) > f.settings.Keep {
+		base := strings.TrimSuffix(rotated[0], ".gz")
+		for _, name := range []string{base, base + ".gz"} {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing %s: %s", name, err.Error())
+			}
+		}
+
+		rotated = rotated[1:]
+	}
+}
+
+// rotatedFiles returns the rotated files of path, oldest first.  A file
+// that is both compressed and not, because compression was interrupted, is
+// listed once by its compressed name.
+func rotatedFiles(path string) ([]string, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(base) + `\.(\d{8}T\d{6}\.\d{6})(?:\.gz)?$`)
+	var rotated, suffixes []string
+	seen := make(map[string]int)
+	for _, entry := range entries {
+		match := re.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Mode().IsRegular() {
+			continue
+		}
+
+		name := filepath.Join(dir, entry.Name())
+		if i, ok := seen[match[1]]; ok {
+			if strings.HasSuffix(name, ".gz") {
+				rotated[i] = name
+			}
+
+			continue
+		}
+
+		seen[match[1]] = len(rotated)
+		rotated = append(rotated, name)
+		suffixes = append(suffixes, match[1])
+	}
+
+	sort.Sort(bySuffix{rotated, suffixes})
+	return rotated, nil
+}
+
+// bySuffix sorts rotated files by their time suffix, regardless of whether
+// they have been compressed.
+type bySuffix struct {
+	paths    []string
+	suffixes []string
+}
+
+func (s bySuffix) Len() int           { return len(s.paths) }
+func (s bySuffix) Less(i, j int) bool { return s.suffixes[i] < s.suffixes[j] }
+func (s bySuffix) Swap(i, j int) {
+	s.paths[i], s.paths[j] = s.paths[j], s.paths[i]
+	s.suffixes[i], s.suffixes[j] = s.suffixes[j], s.suffixes[i]
+}
+
+// compressFile replaces the file with a gzipped copy named path.gz.  The
+// copy is written under a temporary name so that a partial one is never
+// mistaken for a rotated file.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+const (
+	adaptiveInterval    = 15 * time.Second
+	adaptiveMinRate     = 0.1
+	adaptiveMovingRatio = 0.25
+)
+
+// sampler decides whether telemetry items are sent.  Sample returns the
+// sampling percentage that applies to the item and whether it was selected.
+type sampler interface {
+	Sample(t appinsights.Telemetry) (float64, bool)
+}
+
+func newSampler(percentage, itemsPerSecond float64) (sampler, error) {
+	if percentage != 0 && itemsPerSecond != 0 {
+		return nil, fmt.Errorf("Fixed and adaptive sampling cannot be used together")
+	}
+
+	if percentage != 0 {
+		if percentage < 0 || percentage > 100 {
+			return nil, fmt.Errorf("Sampling percentage must be between 0 and 100")
+		}
+
+		return &fixedSampler{roundSamplingRate(percentage)}, nil
+	}
+
+	if itemsPerSecond != 0 {
+		if itemsPerSecond < 0 {
+			return nil, fmt.Errorf("Adaptive sampling target must be positive")
+		}
+
+		return newAdaptiveSampler(itemsPerSecond), nil
+	}
+
+	return nil, nil
+}
+
+type fixedSampler struct {
+	percentage float64
+}
+
+func (s *fixedSampler) Sample(t appinsights.Telemetry) (float64, bool) {
+	return s.percentage, isSampledIn(t, s.percentage)
+}
+
+// adaptiveSampler adjusts its sampling percentage every adaptiveInterval so
+// that about target items per second are sent.
+type adaptiveSampler struct {
+	lock       sync.Mutex
+	target     float64
+	percentage float64
+	average    float64
+	count      int
+	stop       chan struct{}
+}
+
+func newAdaptiveSampler(target float64) *adaptiveSampler {
+	s := &adaptiveSampler{target: target, percentage: 100, stop: make(chan struct{})}
+	go s.evaluate()
+	return s
+}
+
+// Stop ends the periodic evaluation of the sampling percentage.
+func (s *adaptiveSampler) Stop() {
+	close(s.stop)
+}
+
+func (s *adaptiveSampler) Sample(t appinsights.Telemetry) (float64, bool) {
+	s.lock.Lock()
+	s.count++
+	percentage := s.percentage
+	s.lock.Unlock()
+
+	return percentage, isSampledIn(t, percentage)
+}
+
+func (s *adaptiveSampler) evaluate() {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		s.lock.Lock()
+		observed := float64(s.count) / adaptiveInterval.Seconds()
+		s.count = 0
+
+		if s.average == 0 {
+			s.average = observed
+		} else {
+			s.average = adaptiveMovingRatio*observed + (1-adaptiveMovingRatio)*s.average
+		}
+
+		percentage := 100.0
+		if s.average > s.target {
+			percentage = math.Max(100*s.target/s.average, adaptiveMinRate)
+		}
+
+		s.percentage = roundSamplingRate(percentage)
+		s.lock.Unlock()
+	}
+}
+
+// Application Insights expects every sampled item to stand for a whole number
+// of items, so round the percentage down to 100/n.
+func roundSamplingRate(percentage float64) float64 {
+	if percentage >= 100 {
+		return 100
+	}
+
+	return 100 / math.Ceil(100/percentage)
+}
+
+// Items are selected on a score computed from their operation ID so that all
+// telemetry for an operation is kept or dropped together.
+func isSampledIn(t appinsights.Telemetry, percentage float64) bool {
+	tags := t.ContextTags()
+	if percentage >= 100 || tags == nil {
+		return true
+	}
+
+	return samplingScore(ensureOperationId(tags)) < percentage
+}
+
+// samplingScore hashes an operation ID into [0, 100) the same way as the other
+// Application Insights SDKs, so sampling decisions agree across components.
+func samplingScore(id string) float64 {
+	if id == "" {
+		return 0
+	}
+
+	for len(id) < 8 {
+		id += id
+	}
+
+	var hash int32 = 5381
+	for i := 0; i < len(id); i++ {
+		hash = (hash << 5) + hash + int32(id[i])
+	}
+
+	if hash == math.MinInt32 {
+		hash = math.MaxInt32
+	} else if hash < 0 {
+		hash = -hash
+	}
+
+	return float64(hash) / math.MaxInt32 * 100
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+func TestRoundSamplingRate(t *testing.T) {
+	for _, c := range [][]float64{{100, 100}, {150, 100}, {50, 50}, {30, 25}, {10, 10}, {9, 100.0 / 12}} {
+		if r := roundSamplingRate(c[0]); r != c[1] {
+			t.Errorf("roundSamplingRate(%f) = %f, expected %f", c[0], r, c[1])
+		}
+	}
+}
+
+func TestSamplingScore(t *testing.T) {
+	ids := []string{"a", "abcdefgh", "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0", "|123.456."}
+	for _, id := range ids {
+		score := samplingScore(id)
+		if score < 0 || score > 100 {
+			t.Errorf("Score for %s out of range: %f", id, score)
+		}
+
+		if score != samplingScore(id) {
+			t.Errorf("Score for %s is not deterministic", id)
+		}
+	}
+}
+
+func TestSamplingByOperation(t *testing.T) {
+	s, err := newSampler(50, 0)
+	if err != nil {
+		t.Fatalf("newSampler failed: %s", err.Error())
+	}
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		request := appinsights.NewRequestTelemetry("GET", "http://localhost/", 0, "200")
+		trace := appinsights.NewTraceTelemetry("message", appinsights.Information)
+
+		rate, keepRequest := s.Sample(request)
+		if rate != 50 {
+			t.Fatalf("Unexpected sample rate: %f", rate)
+		}
+
+		trace.Tags.Operation().SetId(request.Tags.Operation().GetId())
+		if _, keepTrace := s.Sample(trace); keepTrace != keepRequest {
+			t.Error("Items with the same operation ID should be sampled together")
+		}
+
+		if keepRequest {
+			kept++
+		}
+	}
+
+	if kept < 400 || kept > 600 {
+		t.Errorf("Kept %d of 1000 items at 50%%", kept)
+	}
+}
+
+func TestSamplerErrors(t *testing.T) {
+	if _, err := newSampler(25, 10); err == nil {
+		t.Error("Should not allow fixed and adaptive sampling together")
+	}
+
+	if _, err := newSampler(101, 0); err == nil {
+		t.Error("Should not allow sampling percentage over 100")
+	}
+
+	if s, err := newSampler(0, 0); s != nil || err != nil {
+		t.Error("No sampler should be created by default")
+	}
+}
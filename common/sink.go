@@ -0,0 +1,91 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// jsonChannel is an appinsights.TelemetryChannel that writes envelopes to a
+// file, one JSON object per line, instead of sending them.  They're encoded
+// the same way as the SDK encodes them for transmission.
+type jsonChannel struct {
+	lock    sync.Mutex
+	name    string
+	out     io.Writer
+	file    *os.File
+	encoder *json.Encoder
+	closed  bool
+}
+
+// newSinkChannel creates a channel for a -sink option: 'stdout', or
+// 'file:path'.
+func newSinkChannel(sink string) (*jsonChannel, error) {
+	result := &jsonChannel{name: sink}
+
+	switch {
+	case sink == "stdout":
+		result.out = os.Stdout
+	case strings.HasPrefix(sink, "file:") && len(sink) > len("file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(sink, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+
+		result.file = f
+		result.out = f
+	default:
+		return nil, fmt.Errorf("Invalid sink %q, must be stdout or file:path", sink)
+	}
+
+	result.encoder = json.NewEncoder(result.out)
+	return result, nil
+}
+
+func (channel *jsonChannel) EndpointAddress() string {
+	return channel.name
+}
+
+func (channel *jsonChannel) Send(envelope *contracts.Envelope) {
+	channel.lock.Lock()
+	defer channel.lock.Unlock()
+
+	if channel.closed {
+		return
+	}
+
+	if err := channel.encoder.Encode(envelope); err != nil {
+		log.Printf("Error writing telemetry to %s: %s", channel.name, err.Error())
+	}
+}
+
+// Envelopes are written as they're sent, so there is nothing to flush.
+func (channel *jsonChannel) Flush() {
+}
+
+func (channel *jsonChannel) Stop() {
+}
+
+func (channel *jsonChannel) IsThrottled() bool {
+	return false
+}
+
+func (channel *jsonChannel) Close(retryTimeout ...time.Duration) <-chan struct{} {
+	channel.lock.Lock()
+	if !channel.closed && channel.file != nil {
+		channel.file.Close()
+	}
+	channel.closed = true
+	channel.lock.Unlock()
+
+	result := make(chan struct{})
+	close(result)
+	return result
+}
@@ -0,0 +1,138 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+func TestSinkChannel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "telemetry.jsonl")
+
+	channel, err := newSinkChannel("file:" + path)
+	if err != nil {
+		t.Fatalf("newSinkChannel failed: %s", err.Error())
+	}
+
+	client := newTelemetryClient(appinsights.NewTelemetryConfiguration("ikey"), channel)
+	client.Track(appinsights.NewTraceTelemetry("first", appinsights.Warning), 100)
+	client.Track(appinsights.NewRequestTelemetry("GET", "/", 0, "200"), 25)
+	<-channel.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read sink: %s", err.Error())
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+
+	var envelope struct {
+		Name       string  `json:"name"`
+		IKey       string  `json:"iKey"`
+		SampleRate float64 `json:"sampleRate"`
+	}
+
+	if err := json.Unmarshal([]byte(lines[1]), &envelope); err != nil {
+		t.Fatalf("Failed to parse envelope: %s", err.Error())
+	}
+
+	if envelope.Name != "Microsoft.ApplicationInsights.ikey.Request" || envelope.IKey != "ikey" || envelope.SampleRate != 25 {
+		t.Errorf("Unexpected envelope: %s", lines[1])
+	}
+
+	for _, sink := range []string{"", "file:", "stderr", "http://localhost"} {
+		if _, err := newSinkChannel(sink); err == nil {
+			t.Errorf("Sink %q should be rejected", sink)
+		}
+	}
+}
+
+// deterministicSink tracks requests with timestamps, like nginx logs with
+// $time_local, through a -deterministic sink and returns what it wrote.
+func deterministicSink(t *testing.T, dir string) []byte {
+	path := filepath.Join(dir, "telemetry.jsonl")
+	os.Remove(path)
+
+	fwd, err := newForwarder(&options{sink: "file:" + path, deterministic: true})
+	if err != nil {
+		t.Fatalf("newForwarder failed: %s", err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		telem := appinsights.NewRequestTelemetry("GET", "/", 0, "200")
+		telem.Id = NewId()
+		telem.Timestamp = time.Date(2020, 1, 2, 3, 4, 5+i, 0, time.UTC)
+		fwd.settings.processors.Process(&Item{Telemetry: telem})
+		fwd.client.Track(telem, 100)
+	}
+
+	<-fwd.client.channel.(*jsonChannel).Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read sink: %s", err.Error())
+	}
+
+	return data
+}
+
+func TestSinkDeterministic(t *testing.T) {
+	defer func() { idSource = randomId }()
+
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	data := deterministicSink(t, dir)
+	if again := deterministicSink(t, dir); string(again) != string(data) {
+		t.Errorf("Output differs between runs:\n%s\n%s", data, again)
+	}
+
+	expected := []string{
+		"00000000-0000-0000-0000-000000000001 00000000-0000-0000-0000-000000000002",
+		"00000000-0000-0000-0000-000000000003 00000000-0000-0000-0000-000000000004",
+	}
+
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var envelope struct {
+			Tags map[string]string `json:"tags"`
+			Data struct {
+				BaseData struct {
+					Id string `json:"id"`
+				} `json:"baseData"`
+			} `json:"data"`
+		}
+
+		if err := json.Unmarshal([]byte(line), &envelope); err != nil {
+			t.Fatalf("Failed to parse envelope: %s", err.Error())
+		}
+
+		if ids := envelope.Data.BaseData.Id + " " + envelope.Tags["ai.operation.id"]; ids != expected[i] {
+			t.Errorf("Unexpected IDs %q, expected %q", ids, expected[i])
+		}
+
+		for _, tag := range []string{"ai.cloud.role", "ai.cloud.roleInstance", "ai.device.id", "ai.device.osVersion"} {
+			if _, ok := envelope.Tags[tag]; ok {
+				t.Errorf("Unexpected tag %s in %s", tag, line)
+			}
+		}
+	}
+}
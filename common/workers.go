@@ -0,0 +1,99 @@
+package common
+
+import (
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+// ConcurrentHandler is a LogHandler whose lines can be parsed independently
+// of each other.  With -workers, Parse is called on several goroutines at
+// once instead of Receive, and the telemetry is tracked in the order of the
+// lines.  Handlers whose telemetry depends on earlier lines (such as ones
+// that batch them) shouldn't implement it.
+type ConcurrentHandler interface {
+	LogHandler
+	Parse(line string) (appinsights.Telemetry, error)
+}
+
+// Lines queued per worker, which bounds how far reading can get ahead of
+// tracking
+const jobsPerWorker = 16
+
+// parseJob is a line given to a worker, and its result, which is ready once
+// done is closed.
+type parseJob struct {
+	handler   ConcurrentHandler
+	line      string
+	partial   bool
+	telemetry appinsights.Telemetry
+	err       error
+	done      chan struct{}
+}
+
+// workerPool parses lines on several goroutines.  Jobs are kept in the order
+// they were added, and are taken out in that order as they finish.  It is
+// only used from the pipeline's read loop.
+type workerPool struct {
+	jobs    chan *parseJob
+	pending []*parseJob
+}
+
+func newWorkerPool(workers int) *workerPool {
+	pool := &workerPool{
+		jobs: make(chan *parseJob, workers*jobsPerWorker),
+	}
+
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+func (pool *workerPool) work() {
+	for job := range pool.jobs {
+		job.telemetry, job.err = job.handler.Parse(job.line)
+		close(job.done)
+	}
+}
+
+// add queues a line to be parsed.  It doesn't block unless the pool is full.
+func (pool *workerPool) add(handler ConcurrentHandler, line string, partial bool) {
+	job := &parseJob{
+		handler: handler,
+		line:    line,
+		partial: partial,
+		done:    make(chan struct{}),
+	}
+
+	pool.pending = append(pool.pending, job)
+	pool.jobs <- job
+}
+
+// full returns whether add would block.
+func (pool *workerPool) full() bool {
+	return len(pool.pending) >= cap(pool.jobs)
+}
+
+// next returns a channel that is closed when the oldest job is done, or nil
+// if there are none.
+func (pool *workerPool) next() <-chan struct{} {
+	if len(pool.pending) == 0 {
+		return nil
+	}
+
+	return pool.pending[0].done
+}
+
+// take removes the oldest job, waiting for it if necessary.
+func (pool *workerPool) take() *parseJob {
+	job := pool.pending[0]
+	pool.pending[0] = nil
+	pool.pending = pool.pending[1:]
+	<-job.done
+	return job
+}
+
+// close stops the workers once they finish the queued jobs.
+func (pool *workerPool) close() {
+	close(pool.jobs)
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -17,6 +18,53 @@ const (
 type LogWriter struct {
 	events  chan LogWriterEvent
 	control chan LogWriterControl
+	done    chan struct{}
+}
+
+// OutputSettings controls how a LogWriter writes its file.  The zero value
+// appends to a single file, buffering up to BUF_MAX bytes while it's busy
+// and dropping anything more.
+type OutputSettings struct {
+	// Rotate the file before it grows past this many bytes, or 0 for no limit
+	MaxSize int64
+
+	// Rotate the file after it has been written for this long, or 0
+	MaxAge time.Duration
+
+	// Number of rotated files to keep, or 0 to keep all of them
+	Keep int
+
+	// Whether to gzip rotated files
+	Compress bool
+
+	// Bytes to buffer while the file is busy, or 0 for BUF_MAX
+	BufferSize int
+
+	// Whether to wait for the file rather than drop data when the buffer
+	// is full
+	Block bool
+}
+
+func (settings *OutputSettings) register(flags *flag.FlagSet) {
+	flags.Int64Var(&settings.MaxSize, "outmaxsize", 0, "Rotate -out before it grows past this many bytes, or 0 for no limit")
+	flags.DurationVar(&settings.MaxAge, "outmaxage", 0, "Rotate -out after it has been written for this long, or 0 for no limit")
+	flags.IntVar(&settings.Keep, "outkeep", 0, "Number of rotated -out files to keep, or 0 to keep all of them")
+	flags.BoolVar(&settings.Compress, "outcompress", false, "Compress rotated -out files with gzip")
+	flags.IntVar(&settings.BufferSize, "outbuffer", BUF_MAX, "Bytes of -out data to buffer while the file is busy")
+	flags.BoolVar(&settings.Block, "outblock", false, "Wait for -out instead of dropping data when its buffer is full")
+}
+
+// rotates returns whether the settings call for rotating the file.
+func (settings OutputSettings) rotates() bool {
+	return settings.MaxSize > 0 || settings.MaxAge > 0
+}
+
+func (settings OutputSettings) bufferSize() int {
+	if settings.BufferSize <= 0 {
+		return BUF_MAX
+	}
+
+	return settings.BufferSize
 }
 
 type LogWriterEvent struct {
@@ -38,28 +86,50 @@ type logWriterInternal struct {
 	control  chan LogWriterControl
 	opener   logOpener
 	canReset bool
+	settings OutputSettings
 	file     io.WriteCloser
 }
 
+func newLogWriter() *LogWriter {
+	return &LogWriter{
+		events:  make(chan LogWriterEvent),
+		control: make(chan LogWriterControl),
+		done:    make(chan struct{}),
+	}
+}
+
+// Reset reopens the file, e.g. after it was rotated by another program.
 func (logWriter *LogWriter) Reset() {
-	logWriter.control <- LogWriterControl{reset: true}
+	logWriter.send(LogWriterControl{reset: true})
 }
 
+// Close flushes and closes the file.
 func (logWriter *LogWriter) Close() {
-	logWriter.control <- LogWriterControl{shutdown: true}
+	logWriter.send(LogWriterControl{shutdown: true})
 }
 
+// Write writes msg to the file.  It doesn't block, unless the buffer is full
+// and the writer was created with OutputSettings.Block.
 func (logWriter *LogWriter) Write(msg string) {
-	logWriter.control <- LogWriterControl{data: msg}
+	logWriter.send(LogWriterControl{data: msg})
 }
 
-func NewLogWriter(outfile string) (*LogWriter, error) {
-	logWriter := &LogWriter{make(chan LogWriterEvent), make(chan LogWriterControl)}
+// send passes a message to the writer, unless it has stopped.
+func (logWriter *LogWriter) send(ctl LogWriterControl) {
+	select {
+	case logWriter.control <- ctl:
+	case <-logWriter.done:
+	}
+}
+
+// NewLogWriter writes to a file, '-' for stdout, or 'stderr'.
+func NewLogWriter(outfile string, settings OutputSettings) (*LogWriter, error) {
+	logWriter := newLogWriter()
 
 	if outfile == "-" {
-		startLogWriter(logWriter, func() (io.WriteCloser, error) { return os.Stdout, nil }, false)
+		startLogWriter(logWriter, func() (io.WriteCloser, error) { return os.Stdout, nil }, false, settings)
 	} else if outfile == "stderr" {
-		startLogWriter(logWriter, func() (io.WriteCloser, error) { return os.Stderr, nil }, false)
+		startLogWriter(logWriter, func() (io.WriteCloser, error) { return os.Stderr, nil }, false, settings)
 	} else {
 		stat, err := os.Stat(outfile)
 		if err != nil {
@@ -83,20 +153,25 @@ func NewLogWriter(outfile string) (*LogWriter, error) {
 			}
 		}
 
-		startLogWriter(logWriter, func() (io.WriteCloser, error) { return openLogOut(outfile) }, true)
+		opener := func() (io.WriteCloser, error) { return openLogOut(outfile) }
+		if settings.rotates() {
+			opener = func() (io.WriteCloser, error) { return openRotatingFile(outfile, settings) }
+		}
+
+		startLogWriter(logWriter, opener, true, settings)
 	}
 
 	return logWriter, nil
 }
 
 func NewNilLogWriter() *LogWriter {
-	logWriter := &LogWriter{make(chan LogWriterEvent), make(chan LogWriterControl)}
+	logWriter := newLogWriter()
 
 	go func() {
 		for {
 			ctl := <-logWriter.control
 			if ctl.shutdown {
-				logWriter.events <- LogWriterEvent{closed: true}
+				logWriter.finish(LogWriterEvent{closed: true})
 				return
 			}
 		}
@@ -119,12 +194,13 @@ func openLogOut(outfile string) (io.WriteCloser, error) {
 	return file, nil
 }
 
-func startLogWriter(logWriter *LogWriter, opener logOpener, canReset bool) {
+func startLogWriter(logWriter *LogWriter, opener logOpener, canReset bool, settings OutputSettings) {
 	internal := &logWriterInternal{
 		events:   make(chan LogWriterEvent, CHAN_BUF),
 		control:  make(chan LogWriterControl),
 		opener:   opener,
 		canReset: canReset,
+		settings: settings,
 		file:     nil,
 	}
 
@@ -177,6 +253,19 @@ func (internal *logWriterInternal) writerThread() {
 	}
 }
 
+// finish sends the event that the writer has closed.  Messages that arrive
+// in the meantime are dropped, and afterwards, sending any is a no-op.
+func (logWriter *LogWriter) finish(evt LogWriterEvent) {
+	close(logWriter.done)
+	for {
+		select {
+		case logWriter.events <- evt:
+			return
+		case <-logWriter.control:
+		}
+	}
+}
+
 func (internal *logWriterInternal) controlThread(logWriter *LogWriter) {
 	var buf bytes.Buffer
 	var ready int
@@ -196,7 +285,7 @@ func (internal *logWriterInternal) controlThread(logWriter *LogWriter) {
 					ready += 1
 				}
 			} else {
-				logWriter.events <- evt
+				logWriter.finish(evt)
 				return
 			}
 		case ctl := <-logWriter.control:
@@ -205,9 +294,19 @@ func (internal *logWriterInternal) controlThread(logWriter *LogWriter) {
 					// Writer is ready
 					internal.control <- ctl
 					ready -= 1
-				} else if buf.Len() < BUF_MAX {
+				} else if buf.Len() < internal.settings.bufferSize() {
 					// Not accepting data right now, buffer it.
 					buf.WriteString(ctl.data)
+				} else if internal.settings.Block {
+					// Wait for the writer rather than drop anything.
+					if evt, ok := internal.take(&ready); !ok {
+						logWriter.finish(evt)
+						return
+					}
+
+					buf.WriteString(ctl.data)
+					internal.control <- LogWriterControl{data: buf.String()}
+					buf.Reset()
 				} else {
 					// We have to drop data at this point.
 					droppedBytes += len(ctl.data)
@@ -216,38 +315,44 @@ func (internal *logWriterInternal) controlThread(logWriter *LogWriter) {
 			}
 
 			if ctl.shutdown {
-				if internal.file != nil {
-					internal.file.Close()
+				// The file is closed first so that a write that is stuck,
+				// e.g. on a FIFO, can't hold up the shutdown.  When
+				// blocking, what's buffered is written out instead.
+				evt, ok := internal.stop(&buf, &ready)
+				if !ok {
+					logWriter.finish(evt)
+					return
 				}
+
 				internal.control <- ctl
 			}
 
 			if ctl.reset {
 				if internal.canReset {
 					// Send shutdown control, let it flush out, for up to a second.
+					// When blocking, wait for everything buffered to be written.
 					timeout := time.After(time.Second)
-
-					if internal.file != nil {
-						internal.file.Close()
+					if internal.settings.Block {
+						timeout = nil
 					}
 
-					internal.control <- LogWriterControl{shutdown: true}
-				wait:
-					for {
-						select {
-						case evt := <-internal.events:
-							if evt.closed {
+					if _, ok := internal.stop(&buf, &ready); ok {
+						internal.control <- LogWriterControl{shutdown: true}
+					wait:
+						for {
+							select {
+							case evt := <-internal.events:
+								if evt.closed {
+									break wait
+								}
+							case _ = <-timeout:
+								// Give up.
 								break wait
 							}
-						case _ = <-timeout:
-							// Give up.
-							break wait
 						}
 					}
 
-					startLogWriter(logWriter, internal.opener, internal.canReset)
-					close(internal.events)
-					close(internal.control)
+					startLogWriter(logWriter, internal.opener, internal.canReset, internal.settings)
 					return
 				}
 			}
@@ -261,3 +366,39 @@ func (internal *logWriterInternal) controlThread(logWriter *LogWriter) {
 		}
 	}
 }
+
+// take waits until the writer is ready for another message.  It returns
+// false, with the event, if the writer closed instead.
+func (internal *logWriterInternal) take(ready *int) (LogWriterEvent, bool) {
+	if *ready > 0 {
+		*ready -= 1
+		return LogWriterEvent{ready: true}, true
+	}
+
+	evt := <-internal.events
+	return evt, evt.ready
+}
+
+// stop prepares the writer for a shutdown message.  Unless it's blocking,
+// the file is closed and whatever is buffered is dropped.  It returns false,
+// with the event, if the writer closed instead.
+func (internal *logWriterInternal) stop(buf *bytes.Buffer, ready *int) (LogWriterEvent, bool) {
+	if !internal.settings.Block {
+		if internal.file != nil {
+			internal.file.Close()
+		}
+
+		buf.Reset()
+	}
+
+	for buf.Len() > 0 {
+		if evt, ok := internal.take(ready); !ok {
+			return evt, false
+		}
+
+		internal.control <- LogWriterControl{data: buf.String()}
+		buf.Reset()
+	}
+
+	return internal.take(ready)
+}
@@ -0,0 +1,240 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	return dir
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	f, err := openRotatingFile(path, OutputSettings{MaxSize: 10, Keep: 2})
+	if err != nil {
+		t.Fatalf("openRotatingFile failed: %s", err.Error())
+	}
+
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(f, "line %d\n", i)
+	}
+
+	f.Close()
+
+	rotated, _ := rotatedFiles(path)
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotated files, got %v", rotated)
+	}
+
+	// The newest are kept, and the current file has the last line
+	for i, name := range append(rotated, path) {
+		data, _ := ioutil.ReadFile(name)
+		if expected := fmt.Sprintf("line %d\n", i+2); string(data) != expected {
+			t.Errorf("Expected %s to contain %q, got %q", name, expected, data)
+		}
+	}
+}
+
+func TestRotatingFileConcurrentClose(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	f, err := openRotatingFile(path, OutputSettings{MaxSize: 10, Keep: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("openRotatingFile failed: %s", err.Error())
+	}
+
+	// A writer that isn't blocking is closed from the control goroutine
+	// while the writer goroutine may be rotating
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(f, "line %d\n", i); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := f.Close(); err != nil {
+		t.Errorf("Close failed: %s", err.Error())
+	}
+
+	<-done
+	if _, err := f.Write([]byte("late\n")); err != os.ErrClosed {
+		t.Errorf("Write after Close returned %v", err)
+	}
+
+	if err := f.Close(); err != os.ErrClosed {
+		t.Errorf("Second Close returned %v", err)
+	}
+}
+
+func TestRotatingFileCompress(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	f, err := openRotatingFile(path, OutputSettings{MaxAge: time.Nanosecond, Compress: true})
+	if err != nil {
+		t.Fatalf("openRotatingFile failed: %s", err.Error())
+	}
+
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(f, "line %d\n", i)
+	}
+
+	f.Close()
+
+	rotated, _ := rotatedFiles(path)
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotated files, got %v", rotated)
+	}
+
+	for i, name := range rotated {
+		if !strings.HasSuffix(name, ".gz") {
+			t.Errorf("%s wasn't compressed", name)
+			continue
+		}
+
+		file, _ := os.Open(name)
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Invalid gzip file %s: %s", name, err.Error())
+		}
+
+		data, _ := ioutil.ReadAll(zr)
+		file.Close()
+		if expected := fmt.Sprintf("line %d\n", i); string(data) != expected {
+			t.Errorf("Expected %s to contain %q, got %q", name, expected, data)
+		}
+	}
+
+	if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) != 0 {
+		t.Errorf("Temporary files left behind: %v", matches)
+	}
+}
+
+func TestRotatingFileCompressKeep(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	f, err := openRotatingFile(path, OutputSettings{MaxSize: 10, Keep: 3, Compress: true})
+	if err != nil {
+		t.Fatalf("openRotatingFile failed: %s", err.Error())
+	}
+
+	// Compression and pruning of each rotation overlap with the next ones
+	const lines = 50
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(f, "line %d\n", i)
+	}
+
+	f.Close()
+
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 3 {
+		t.Fatalf("Expected 3 rotated files, got %v", matches)
+	}
+
+	rotated, _ := rotatedFiles(path)
+	for i, name := range rotated {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %s", name, err.Error())
+		}
+
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Invalid gzip file %s: %s", name, err.Error())
+		}
+
+		data, _ := ioutil.ReadAll(zr)
+		file.Close()
+		if expected := fmt.Sprintf("line %d\n", lines-4+i); string(data) != expected {
+			t.Errorf("Expected %s to contain %q, got %q", name, expected, data)
+		}
+	}
+}
+
+func TestRotatedFilesInterrupted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	// Compression stopped between writing the copy and removing the
+	// original, which still counts as one rotated file
+	for _, name := range []string{".20200101T000000.000000", ".20200101T000000.000000.gz", ".20200102T000000.000000", ".20200103T000000.000000.gz"} {
+		ioutil.WriteFile(path+name, nil, 0666)
+	}
+
+	rotated, _ := rotatedFiles(path)
+	expected := []string{path + ".20200101T000000.000000.gz", path + ".20200102T000000.000000", path + ".20200103T000000.000000.gz"}
+	if strings.Join(rotated, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Expected %v, got %v", expected, rotated)
+	}
+
+	(&rotatingFile{path: path, settings: OutputSettings{Keep: 2}}).prune()
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 2 {
+		t.Errorf("Expected 2 rotated files after pruning, got %v", matches)
+	}
+}
+
+func TestLogWriterBlock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	// A small buffer would drop most of these lines without -outblock
+	writer, err := NewLogWriter(path, OutputSettings{BufferSize: 16, Block: true})
+	if err != nil {
+		t.Fatalf("NewLogWriter failed: %s", err.Error())
+	}
+
+	var expected strings.Builder
+	for i := 0; i < 1000; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		expected.WriteString(line)
+		writer.Write(line)
+		if i == 500 {
+			writer.Reset()
+		}
+	}
+
+	writer.Close()
+	select {
+	case event := <-writer.events:
+		if !event.closed || event.err != nil {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writer didn't close")
+	}
+
+	// Once it's closed, these don't block
+	writer.Write("more\n")
+	writer.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != expected.String() {
+		t.Errorf("Output is missing lines: got %d bytes, expected %d", len(data), expected.Len())
+	}
+}
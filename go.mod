@@ -2,4 +2,8 @@ module github.com/jjjordanmsft/ApplicationInsights-logforward
 
 go 1.13
 
-require github.com/microsoft/ApplicationInsights-Go v0.4.4
+require (
+	github.com/gofrs/uuid v3.3.0+incompatible
+	github.com/microsoft/ApplicationInsights-Go v0.4.4
+	gopkg.in/yaml.v2 v2.4.0
+)
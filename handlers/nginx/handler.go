@@ -0,0 +1,70 @@
+package nginx
+
+import (
+	"flag"
+	"log"
+
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+func init() {
+	common.RegisterHandler("nginx", NewHandler)
+}
+
+// NewHandler creates a handler that sends nginx access logs as requests.
+func NewHandler(flags *flag.FlagSet) common.LogHandler {
+	handler := &Handler{}
+	flags.Var(&handler.formats, "format", "nginx log format (required). Can be used multiple times for logs with lines in several formats")
+	flags.BoolVar(&handler.noReject, "noreject", false, "don't reject log lines that may not parse perfectly")
+	flags.BoolVar(&handler.noQuery, "noquery", false, "don't log query params in request url")
+	flags.Var(&handler.names.Routes, "route", "Route template like '/users/{id}/orders' to use as request name for matching paths. Can be used multiple times")
+	flags.Var(&handler.names.Replacements, "namereplace", "Regex replacement like '|pattern|replacement|' applied to paths in request names. Can be used multiple times")
+	flags.Var(&handler.mappings, "map", "Map an nginx variable like 'name=action[:target]', where action is drop, property, measurement or tag. Can be used multiple times")
+	flags.BoolVar(&handler.names.CollapseIds, "collapseids", false, "Replace numeric, UUID and hex ID path segments in request names with {id}")
+	return handler
+}
+
+type Handler struct {
+	formats  formatList
+	noReject bool
+	noQuery  bool
+	names    NameNormalizer
+	mappings VariableMappings
+	msgs     *log.Logger
+	tracker  common.Tracker
+	parser   *LogParser
+}
+
+func (handler *Handler) Initialize(msgs *log.Logger, tracker common.Tracker) error {
+	handler.msgs = msgs
+	handler.tracker = tracker
+
+	if len(handler.formats) == 0 {
+		handler.formats = formatList{defaultFormat}
+	}
+
+	var err error
+	handler.parser, err = NewLogParser(handler.formats, handler.noReject, handler.noQuery, &handler.names, handler.mappings)
+	return err
+}
+
+func (handler *Handler) Receive(line string) error {
+	t, err := handler.Parse(line)
+	if t != nil {
+		handler.tracker.Track(t)
+	}
+
+	return err
+}
+
+// Parse creates telemetry for a line without tracking it.  It may be called
+// concurrently.
+func (handler *Handler) Parse(line string) (appinsights.Telemetry, error) {
+	t, err := handler.parser.CreateTelemetry(line)
+	if err != nil || t == nil {
+		return nil, err
+	}
+
+	return t, nil
+}
@@ -0,0 +1,136 @@
+package nginx
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+)
+
+func TestHandlerReceive(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	handler := NewHandler(flags)
+	if err := flags.Parse([]string{"-format", `$remote_addr [$time_local] "$request" $status`, "-collapseids"}); err != nil {
+		t.Fatalf("Parse failed: %s", err.Error())
+	}
+
+	var tracked []appinsights.Telemetry
+	tracker := common.TrackerFunc(func(t appinsights.Telemetry) {
+		tracked = append(tracked, t)
+	})
+
+	if err := handler.Initialize(log.New(ioutil.Discard, "", 0), tracker); err != nil {
+		t.Fatalf("Initialize failed: %s", err.Error())
+	}
+
+	if err := handler.Receive(`10.0.0.1 [18/Oct/2026:10:00:00 +0000] "GET /users/123 HTTP/1.1" 404`); err != nil {
+		t.Fatalf("Receive failed: %s", err.Error())
+	}
+
+	if handler.Receive("garbage") == nil {
+		t.Error("Receive should fail for unparseable lines")
+	}
+
+	if len(tracked) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(tracked))
+	}
+
+	request, ok := tracked[0].(*appinsights.RequestTelemetry)
+	if !ok {
+		t.Fatalf("Expected request telemetry, got %T", tracked[0])
+	}
+
+	if request.Name != "GET /users/{id}" || request.ResponseCode != "404" || request.Success {
+		t.Errorf("Unexpected request: %s %s %v", request.Name, request.ResponseCode, request.Success)
+	}
+}
+
+func TestHandlerMultipleFormats(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	handler := NewHandler(flags)
+	if err := flags.Parse([]string{
+		"-format", `$remote_addr [$time_local] "$request" $status $request_time`,
+		"-format", `$remote_addr [$time_local] "$request" ${status:int}`,
+	}); err != nil {
+		t.Fatalf("Parse failed: %s", err.Error())
+	}
+
+	var tracked []*appinsights.RequestTelemetry
+	tracker := common.TrackerFunc(func(t appinsights.Telemetry) {
+		tracked = append(tracked, t.(*appinsights.RequestTelemetry))
+	})
+
+	if err := handler.Initialize(log.New(ioutil.Discard, "", 0), tracker); err != nil {
+		t.Fatalf("Initialize failed: %s", err.Error())
+	}
+
+	for _, line := range []string{
+		`10.0.0.1 [18/Oct/2026:10:00:00 +0000] "GET / HTTP/1.1" 200`,
+		`10.0.0.1 [18/Oct/2026:10:00:00 +0000] "GET / HTTP/1.1" 200 0.5`,
+		`10.0.0.1 [18/Oct/2026:10:00:00 +0000] "GET / HTTP/1.1" 200 0.25`,
+	} {
+		if err := handler.Receive(line); err != nil {
+			t.Fatalf("Receive failed: %s", err.Error())
+		}
+	}
+
+	if len(tracked) != 3 {
+		t.Fatalf("Expected 3 items, got %d", len(tracked))
+	}
+
+	for i, expected := range []string{"2", "1", "1"} {
+		if actual := tracked[i].Properties[formatProperty]; actual != expected {
+			t.Errorf("Item %d: expected format %s, got %q", i, expected, actual)
+		}
+	}
+
+	if tracked[2].Duration.Seconds() != 0.25 {
+		t.Errorf("Unexpected duration: %s", tracked[2].Duration)
+	}
+}
+
+func TestHandlerParseConcurrent(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	handler := NewHandler(flags).(*Handler)
+	if err := flags.Parse([]string{
+		"-format", `$remote_addr [$time_local] "$request" $status $request_time`,
+		"-format", `$remote_addr [$time_local] "$request" ${status:int}`,
+	}); err != nil {
+		t.Fatalf("Parse failed: %s", err.Error())
+	}
+
+	if err := handler.Initialize(log.New(ioutil.Discard, "", 0), nil); err != nil {
+		t.Fatalf("Initialize failed: %s", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				line := fmt.Sprintf(`10.0.0.1 [18/Oct/2026:10:00:00 +0000] "GET /%d HTTP/1.1" 200`, j)
+				if (i+j)%2 == 0 {
+					line += " 0.5"
+				}
+
+				telem, err := handler.Parse(line)
+				if err != nil {
+					t.Errorf("Parse failed: %s", err.Error())
+					return
+				}
+
+				if url := telem.(*appinsights.RequestTelemetry).Url; url != fmt.Sprintf("/%d", j) {
+					t.Errorf("Unexpected URL: %s", url)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
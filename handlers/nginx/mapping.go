@@ -0,0 +1,133 @@
+package nginx
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+const (
+	mapDrop        = "drop"
+	mapProperty    = "property"
+	mapMeasurement = "measurement"
+	mapTag         = "tag"
+)
+
+var (
+	mappableTags = map[string]bool{
+		contracts.ApplicationVersion:       true,
+		contracts.CloudRole:                true,
+		contracts.CloudRoleInstance:        true,
+		contracts.DeviceId:                 true,
+		contracts.DeviceLocale:             true,
+		contracts.DeviceModel:              true,
+		contracts.DeviceOEMName:            true,
+		contracts.DeviceOSVersion:          true,
+		contracts.DeviceType:               true,
+		contracts.LocationIp:               true,
+		contracts.OperationId:              true,
+		contracts.OperationParentId:        true,
+		contracts.OperationSyntheticSource: true,
+		contracts.SessionId:                true,
+		contracts.SessionIsFirst:           true,
+		contracts.UserAccountId:            true,
+		contracts.UserAuthUserId:           true,
+		contracts.UserId:                   true,
+	}
+)
+
+// variableMapping says what to do with an nginx variable that would
+// otherwise be sent as a property or measurement.
+type variableMapping struct {
+	spec   string
+	action string
+	name   string
+}
+
+// VariableMappings is a flag.Value of mappings like 'name=action[:target]',
+// keyed by variable name.
+type VariableMappings map[string]*variableMapping
+
+func (mappings *VariableMappings) String() string {
+	if len(*mappings) == 0 {
+		return ""
+	}
+
+	var specs []string
+	for _, m := range *mappings {
+		specs = append(specs, m.spec)
+	}
+	sort.Strings(specs)
+
+	var buf bytes.Buffer
+	for _, spec := range specs {
+		if buf.Len() > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%q", spec)
+	}
+
+	return buf.String()
+}
+
+func (mappings *VariableMappings) Set(value string) error {
+	eq := strings.IndexByte(value, '=')
+	if eq <= 0 {
+		return fmt.Errorf("Invalid mapping (should be 'variable=action[:target]')")
+	}
+
+	variable := strings.TrimPrefix(value[:eq], "$")
+	action := value[eq+1:]
+	name := variable
+	if colon := strings.IndexByte(action, ':'); colon >= 0 {
+		action, name = action[:colon], action[colon+1:]
+		if name == "" {
+			return fmt.Errorf("Missing target in mapping for %s", variable)
+		}
+	}
+
+	switch action {
+	case mapDrop, mapProperty, mapMeasurement:
+	case mapTag:
+		if name == variable {
+			return fmt.Errorf("Missing tag name in mapping for %s", variable)
+		}
+
+		if !strings.HasPrefix(name, "ai.") {
+			name = "ai." + name
+		}
+
+		if !mappableTags[name] {
+			return fmt.Errorf("Unknown context tag in mapping for %s: %s", variable, name)
+		}
+	default:
+		return fmt.Errorf("Invalid mapping action for %s, must be one of: drop, property, measurement, tag", variable)
+	}
+
+	if *mappings == nil {
+		*mappings = make(VariableMappings)
+	}
+
+	(*mappings)[variable] = &variableMapping{value, action, name}
+	return nil
+}
+
+func (m *variableMapping) apply(telem *appinsights.RequestTelemetry, value string) {
+	switch m.action {
+	case mapProperty:
+		telem.Properties[m.name] = value
+	case mapMeasurement:
+		if fl, err := strconv.ParseFloat(value, 64); err == nil {
+			telem.Measurements[m.name] = fl
+		} else {
+			telem.Properties[m.name] = value
+		}
+	case mapTag:
+		telem.Tags[m.name] = value
+	}
+}
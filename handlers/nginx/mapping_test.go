@@ -0,0 +1,64 @@
+package nginx
+
+import (
+	"testing"
+)
+
+func TestVariableMappings(t *testing.T) {
+	var mappings VariableMappings
+	for _, m := range []string{
+		"upstream_cache_status=property:cache_status",
+		"$ssl_protocol=drop",
+		"body_bytes_sent=property",
+		"app_time=measurement",
+		"http_x_session=tag:session.id",
+		"remote_addr=property:client",
+	} {
+		if err := mappings.Set(m); err != nil {
+			t.Fatalf("Failed to set mapping %s: %s", m, err.Error())
+		}
+	}
+
+	parser, err := NewLogParser([]string{`$remote_addr [$time_local] "$request" $status $body_bytes_sent $upstream_cache_status $ssl_protocol $app_time $http_x_session`}, false, false, nil, mappings)
+	if err != nil {
+		t.Fatalf("NewLogParser failed: %s", err.Error())
+	}
+
+	telem, err := parser.CreateTelemetry(`10.0.0.1 [18/Oct/2026:10:00:00 +0000] "GET / HTTP/1.1" 200 512 HIT TLSv1.2 0.25 abc123`)
+	if err != nil {
+		t.Fatalf("CreateTelemetry failed: %s", err.Error())
+	}
+
+	if telem.Properties["cache_status"] != "HIT" {
+		t.Error("upstream_cache_status should be renamed")
+	}
+
+	if _, ok := telem.Properties["ssl_protocol"]; ok {
+		t.Error("ssl_protocol should be dropped")
+	}
+
+	if telem.Properties["body_bytes_sent"] != "512" {
+		t.Error("body_bytes_sent should be a property")
+	}
+
+	if telem.Measurements["app_time"] != 0.25 {
+		t.Error("app_time should be a measurement")
+	}
+
+	if telem.Tags.Session().GetId() != "abc123" {
+		t.Error("http_x_session should be the session ID")
+	}
+
+	if telem.Properties["client"] != "10.0.0.1" || telem.Tags.Location().GetIp() != "10.0.0.1" {
+		t.Error("remote_addr should still be used as the client IP")
+	}
+}
+
+func TestInvalidVariableMappings(t *testing.T) {
+	var mappings VariableMappings
+	for _, m := range []string{"foo", "=drop", "foo=rename", "foo=tag", "foo=tag:bogus.id", "foo=property:"} {
+		if err := mappings.Set(m); err == nil {
+			t.Errorf("Mapping %q should be rejected", m)
+		}
+	}
+}
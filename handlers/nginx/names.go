@@ -0,0 +1,170 @@
+package nginx
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]*[0-9][0-9a-fA-F]*$`)
+)
+
+const (
+	collapsedId    = "{id}"
+	minHexIdLength = 8
+)
+
+// NameNormalizer rewrites request paths into operation names so that
+// requests for the same resource are grouped together.
+type NameNormalizer struct {
+	Routes       routeList
+	Replacements replacementList
+	CollapseIds  bool
+}
+
+// Normalize returns the path to use in the operation name.  Routes are tried
+// first; if none match, the replacements and ID collapsing are applied.
+func (normalizer *NameNormalizer) Normalize(path string) string {
+	if route, ok := normalizer.Routes.Match(path); ok {
+		return route
+	}
+
+	for _, r := range normalizer.Replacements {
+		path = r.re.ReplaceAllString(path, r.replacement)
+	}
+
+	if normalizer.CollapseIds {
+		path = collapseIds(path)
+	}
+
+	return path
+}
+
+func collapseIds(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if numericSegment.MatchString(segment) || uuidSegment.MatchString(segment) ||
+			(len(segment) >= minHexIdLength && hexSegment.MatchString(segment)) {
+			segments[i] = collapsedId
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Route template like /users/{id}/orders, where {...} matches any single
+// path segment.
+type route struct {
+	template string
+	segments []string
+}
+
+type routeList []*route
+
+func (lst *routeList) String() string {
+	if len(*lst) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for _, r := range *lst {
+		if buf.Len() > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%q", r.template)
+	}
+
+	return buf.String()
+}
+
+func (lst *routeList) Set(value string) error {
+	if !strings.HasPrefix(value, "/") {
+		return fmt.Errorf("Route must begin with '/'")
+	}
+
+	*lst = append(*lst, &route{value, strings.Split(value, "/")})
+	return nil
+}
+
+func (lst *routeList) Match(path string) (string, bool) {
+	if len(*lst) == 0 {
+		return "", false
+	}
+
+	segments := strings.Split(path, "/")
+	for _, r := range *lst {
+		if r.match(segments) {
+			return r.template, true
+		}
+	}
+
+	return "", false
+}
+
+func (r *route) match(segments []string) bool {
+	if len(segments) != len(r.segments) {
+		return false
+	}
+
+	for i, tmpl := range r.segments {
+		if strings.HasPrefix(tmpl, "{") && strings.HasSuffix(tmpl, "}") {
+			if segments[i] == "" {
+				return false
+			}
+		} else if tmpl != segments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Regex replacement in sed-like syntax, where the first character is the
+// delimiter, e.g. |^/v[0-9]+/|/{version}/|
+type replacement struct {
+	expr        string
+	re          *regexp.Regexp
+	replacement string
+}
+
+type replacementList []*replacement
+
+func (lst *replacementList) String() string {
+	if len(*lst) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for _, r := range *lst {
+		if buf.Len() > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%q", r.expr)
+	}
+
+	return buf.String()
+}
+
+func (lst *replacementList) Set(value string) error {
+	if len(value) < 3 {
+		return fmt.Errorf("Invalid replacement (should be like '/regex/replacement/')")
+	}
+
+	// The first character is the delimiter
+	parts := strings.Split(value[1:], value[0:1])
+	if len(parts) != 3 || parts[2] != "" {
+		return fmt.Errorf("Invalid replacement (should be like '/regex/replacement/')")
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return err
+	}
+
+	*lst = append(*lst, &replacement{value, re, parts[1]})
+	return nil
+}
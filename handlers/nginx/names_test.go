@@ -0,0 +1,91 @@
+package nginx
+
+import (
+	"testing"
+)
+
+func normalizeTest(t *testing.T, normalizer *NameNormalizer, path, expected string) {
+	if actual := normalizer.Normalize(path); actual != expected {
+		t.Errorf("Normalize(%q) = %q, expected %q", path, actual, expected)
+	}
+}
+
+func TestCollapseIds(t *testing.T) {
+	normalizer := &NameNormalizer{CollapseIds: true}
+	normalizeTest(t, normalizer, "/users/12345/orders", "/users/{id}/orders")
+	normalizeTest(t, normalizer, "/items/0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0", "/items/{id}")
+	normalizeTest(t, normalizer, "/commit/9fceb02d0ae598e95dc970b74767f19372d61af8/", "/commit/{id}/")
+	normalizeTest(t, normalizer, "/static/facade/index.html", "/static/facade/index.html")
+	normalizeTest(t, normalizer, "/v2/abc1", "/v2/abc1")
+}
+
+func TestRoutes(t *testing.T) {
+	normalizer := &NameNormalizer{CollapseIds: true}
+	for _, r := range []string{"/users/{user}/orders", "/users/{user}"} {
+		if err := normalizer.Routes.Set(r); err != nil {
+			t.Fatalf("Failed to add route %s: %s", r, err.Error())
+		}
+	}
+
+	normalizeTest(t, normalizer, "/users/jdoe/orders", "/users/{user}/orders")
+	normalizeTest(t, normalizer, "/users/jdoe", "/users/{user}")
+	normalizeTest(t, normalizer, "/users//orders", "/users//orders")
+	normalizeTest(t, normalizer, "/users/jdoe/orders/5", "/users/jdoe/orders/{id}")
+
+	if err := normalizer.Routes.Set("users/{id}"); err == nil {
+		t.Error("Route without leading slash should be rejected")
+	}
+}
+
+func TestReplacements(t *testing.T) {
+	normalizer := &NameNormalizer{}
+	if err := normalizer.Replacements.Set("|^/v[0-9]+/|/{version}/|"); err != nil {
+		t.Fatalf("Failed to add replacement: %s", err.Error())
+	}
+
+	normalizeTest(t, normalizer, "/v3/users", "/{version}/users")
+	normalizeTest(t, normalizer, "/users/v3/", "/users/v3/")
+
+	for _, invalid := range []string{"|a|b", "|a|b|c|", "|(|b|", "x"} {
+		if err := normalizer.Replacements.Set(invalid); err == nil {
+			t.Errorf("Replacement %q should be rejected", invalid)
+		}
+	}
+}
+
+func TestNormalizedName(t *testing.T) {
+	normalizer := &NameNormalizer{CollapseIds: true}
+	log := map[string]string{
+		"scheme":  "https",
+		"host":    "example.com",
+		"request": "GET /users/12345/orders?page=2 HTTP/1.1",
+	}
+
+	name, err := parseName(log, normalizer)
+	if err != nil {
+		t.Fatalf("parseName failed: %s", err.Error())
+	}
+
+	if name != "GET https://example.com/users/{id}/orders" {
+		t.Errorf("Unexpected name: %s", name)
+	}
+
+	url, _ := parseUrl(log, false)
+	if url != "https://example.com/users/12345/orders?page=2" {
+		t.Errorf("URL should not be normalized: %s", url)
+	}
+}
+
+func TestNormalizeUrl(t *testing.T) {
+	normalizer := &NameNormalizer{CollapseIds: true}
+	for uri, expected := range map[string]string{
+		"https://example.com/users/12345#top":        "https://example.com/users/{id}#top",
+		"https://example.com/users/12345?page=2#top": "https://example.com/users/{id}?page=2#top",
+		"/users/12345/orders#a%20b":                  "/users/{id}/orders#a%20b",
+		"/users/12345":                               "/users/{id}",
+	} {
+		if actual := normalizeUrl(uri, normalizer); actual != expected {
+			t.Errorf("normalizeUrl(%q) = %q, expected %q", uri, actual, expected)
+		}
+	}
+}
@@ -1,10 +1,11 @@
-package main
+package nginx
 
 import (
 	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/microsoft/ApplicationInsights-Go/appinsights"
@@ -57,38 +58,101 @@ var (
 	}
 )
 
+// Property that tells which format a line matched, if there are several
+const formatProperty = "LogFormat"
+
+// formatList is a flag.Value of log formats.
+type formatList []string
+
+func (formats *formatList) String() string {
+	return strings.Join(*formats, ", ")
+}
+
+func (formats *formatList) Set(value string) error {
+	*formats = append(*formats, value)
+	return nil
+}
+
 type LogParser struct {
-	parser   *common.Parser
-	noReject bool
-	noQuery  bool
+	parsers    []*common.Parser
+	last       int32
+	noReject   bool
+	noQuery    bool
+	normalizer *NameNormalizer
+	mappings   VariableMappings
 }
 
-func NewLogParser(logFormat string, noReject bool, noQuery bool) (*LogParser, error) {
-	parser, err := common.NewParser(logFormat, &common.ParserOptions{
-		VariableRegex:  `\$[a-zA-Z0-9_]+`,
-		EscapeRegex:    `\\x[0-9a-fA-F]{2}|\\[\\"]|\\u[0-9a-fA-F]{4}`,
-		Unescape:       common.UnescapeCommon,
-		UnwrapVariable: func(v string) string { return v[1:] },
-	})
+// NewLogParser creates a parser for lines in any of the log formats.
+func NewLogParser(logFormats []string, noReject bool, noQuery bool, normalizer *NameNormalizer, mappings VariableMappings) (*LogParser, error) {
+	var parsers []*common.Parser
+	for i, logFormat := range logFormats {
+		parser, err := common.NewParser(logFormat, &common.ParserOptions{
+			VariableRegex:  `\$[a-zA-Z0-9_]+`,
+			EscapeRegex:    `\\x[0-9a-fA-F]{2}|\\[\\"]|\\u[0-9a-fA-F]{4}`,
+			Unescape:       common.UnescapeCommon,
+			UnwrapVariable: func(v string) string { return v[1:] },
+		})
 
-	if err != nil {
-		return nil, err
+		if err != nil {
+			if len(logFormats) > 1 {
+				return nil, fmt.Errorf("Format %d: %s", i+1, err.Error())
+			}
+
+			return nil, err
+		}
+
+		parsers = append(parsers, parser)
 	}
 
 	return &LogParser{
-		parser:   parser,
-		noReject: noReject,
-		noQuery:  noQuery,
+		parsers:    parsers,
+		noReject:   noReject,
+		noQuery:    noQuery,
+		normalizer: normalizer,
+		mappings:   mappings,
 	}, nil
 }
 
+// Parse reads the variables from a line, and returns the index of the format
+// that it matched.  The format that matched the previous line is tried
+// first, since consecutive lines are most likely in the same format.  If
+// none match, the error is from that format.
+func (parser *LogParser) Parse(line string) (map[string]string, int, error) {
+	return parser.parse(line, (*common.Parser).ParseToMap)
+}
+
+func (parser *LogParser) parse(line string, parse func(*common.Parser, string) (map[string]string, error)) (map[string]string, int, error) {
+	// Lines may be parsed concurrently
+	last := int(atomic.LoadInt32(&parser.last))
+	values, err := parse(parser.parsers[last], line)
+	if err == nil {
+		return values, last, nil
+	}
+
+	for i, p := range parser.parsers {
+		if i == last {
+			continue
+		}
+
+		if values, perr := parse(p, line); perr == nil {
+			atomic.StoreInt32(&parser.last, int32(i))
+			return values, i, nil
+		}
+	}
+
+	return nil, 0, err
+}
+
 func (parser *LogParser) CreateTelemetry(line string) (*appinsights.RequestTelemetry, error) {
-	log, err := parser.parser.ParseToMap(strings.TrimRight(line, "\r\n"))
+	// The variables are copied into the telemetry, so the map can be reused
+	log, format, err := parser.parse(strings.TrimRight(line, "\r\n"), (*common.Parser).ParseToPooledMap)
 	if err != nil {
 		return nil, err
 	}
 
-	name, err := parseName(log)
+	defer parser.parsers[format].Release(log)
+
+	name, err := parseName(log, parser.normalizer)
 	if err != nil && !parser.noReject {
 		return nil, fmt.Errorf("Error parsing request name: %s", err.Error())
 	}
@@ -119,6 +183,7 @@ func (parser *LogParser) CreateTelemetry(line string) (*appinsights.RequestTelem
 	}
 
 	telem := appinsights.NewRequestTelemetry(method, url, duration, responseCode)
+	telem.Id = common.NewId()
 	telem.Timestamp = timestamp
 
 	// Optional properties
@@ -135,11 +200,28 @@ func (parser *LogParser) CreateTelemetry(line string) (*appinsights.RequestTelem
 	}
 
 	tags.Operation().SetName(name)
+	if name != "" {
+		telem.Name = name
+	}
+
+	if len(parser.parsers) > 1 {
+		telem.Properties[formatProperty] = strconv.Itoa(format + 1)
+	}
 
 	// Anything else in the log that isn't covered here should be included
 	// as properties. We assume that if it's in the log, you want that data.
 	for k, v := range log {
-		if _, ok := ignoreProperties[k]; !ok && v != "-" {
+		if v == "-" {
+			continue
+		}
+
+		if mapping, ok := parser.mappings[k]; ok {
+			// Explicitly mapped, possibly overriding the defaults below
+			mapping.apply(telem, v)
+			continue
+		}
+
+		if _, ok := ignoreProperties[k]; !ok {
 			if _, ok := measurementVariables[k]; ok {
 				// Some numbers (time/byte counts) go into measurements
 				if fl, err := strconv.ParseFloat(v, 64); err == nil {
@@ -157,8 +239,12 @@ func (parser *LogParser) CreateTelemetry(line string) (*appinsights.RequestTelem
 	return telem, nil
 }
 
-func parseName(log map[string]string) (string, error) {
+func parseName(log map[string]string, normalizer *NameNormalizer) (string, error) {
 	if url, err := parseUrl(log, true); err == nil {
+		if normalizer != nil {
+			url = normalizeUrl(url, normalizer)
+		}
+
 		if method, err := parseMethod(log); err == nil {
 			return fmt.Sprintf("%s %s", method, url), nil
 		} else {
@@ -169,6 +255,25 @@ func parseName(log map[string]string) (string, error) {
 	return "", fmt.Errorf("No key exists to get request name")
 }
 
+// Normalizes the path of the URL, leaving everything else intact.  The path
+// isn't escaped, so that placeholders like {id} stay readable, which is why
+// it's put between the rest of the URL and the query and fragment by hand.
+func normalizeUrl(uri string, normalizer *NameNormalizer) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	path := normalizer.Normalize(parsed.Path)
+	suffix := &url.URL{RawQuery: parsed.RawQuery, ForceQuery: parsed.ForceQuery, Fragment: parsed.Fragment}
+	parsed.Path = ""
+	parsed.RawPath = ""
+	parsed.RawQuery = ""
+	parsed.ForceQuery = false
+	parsed.Fragment = ""
+	return parsed.String() + path + suffix.String()
+}
+
 func parseTimestamp(log map[string]string) (time.Time, error) {
 	// nginx's timestamp comes at the time of response, but we want the time of the
 	// request.  If duration is available (non-zero) then this will correctly calculate
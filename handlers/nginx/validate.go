@@ -0,0 +1,149 @@
+package nginx
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common"
+)
+
+// Longest line that Validate will read
+const maxValidateLine = 1024 * 1024
+
+// Validate parses the lines of the files named in args (or stdin if there are
+// none) with the handler options in args, and reports the variables and
+// telemetry from each line, or where it failed to match the format.  It
+// returns an exit code: 0 if every line parsed, 1 if any didn't, and 2 for
+// invalid options.
+func Validate(name string, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet(name+" validate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [options] [file ...]\n", name)
+		flags.PrintDefaults()
+	}
+
+	handler := NewHandler(flags).(*Handler)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := handler.Initialize(log.New(ioutil.Discard, "", 0), nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid format: %s\n", err.Error())
+		return 2
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	total, failed := 0, 0
+	for _, file := range files {
+		t, f, err := validateFile(out, handler.parser, file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", file, err.Error())
+			return 2
+		}
+
+		total += t
+		failed += f
+	}
+
+	fmt.Fprintf(out, "%d lines, %d failed\n", total, failed)
+	if failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func validateFile(out io.Writer, parser *LogParser, file string) (int, int, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		defer f.Close()
+		r = f
+	}
+
+	total, failed := 0, 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxValidateLine)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		total++
+		if !validateLine(out, parser, fmt.Sprintf("%s:%d", file, lineno), line) {
+			failed++
+		}
+	}
+
+	return total, failed, scanner.Err()
+}
+
+func validateLine(out io.Writer, parser *LogParser, source, line string) bool {
+	vars, format, err := parser.Parse(line)
+	if err != nil {
+		fmt.Fprintf(out, "%s: FAIL: %s\n", source, err.Error())
+		if perr, ok := err.(*common.ParseError); ok {
+			// Point at where the format stopped matching
+			fmt.Fprintf(out, "    %s\n    %s^\n", line, strings.Repeat(" ", perr.Offset))
+		}
+
+		return false
+	}
+
+	telem, err := parser.CreateTelemetry(line)
+	if err != nil {
+		fmt.Fprintf(out, "%s: FAIL: %s\n", source, err.Error())
+	} else {
+		fmt.Fprintf(out, "%s: OK\n", source)
+	}
+
+	if len(parser.parsers) > 1 {
+		fmt.Fprintf(out, "  format: %d\n", format+1)
+	}
+
+	var names []string
+	for k := range vars {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	fmt.Fprintf(out, "  variables:\n")
+	for _, k := range names {
+		fmt.Fprintf(out, "    $%s = %q\n", k, vars[k])
+	}
+
+	if err != nil {
+		return false
+	}
+
+	data, err := json.MarshalIndent(struct {
+		Time time.Time         `json:"time"`
+		Tags map[string]string `json:"tags"`
+		Data interface{}       `json:"data"`
+	}{telem.Time(), telem.ContextTags(), telem.TelemetryData()}, "    ", "  ")
+	if err != nil {
+		fmt.Fprintf(out, "%s: FAIL: %s\n", source, err.Error())
+		return false
+	}
+
+	fmt.Fprintf(out, "  telemetry:\n    %s\n", data)
+	return true
+}
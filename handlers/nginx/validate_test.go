@@ -0,0 +1,47 @@
+package nginx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	lines := "10.0.0.1 [18/Oct/2026:10:00:00 +0000] \"GET / HTTP/1.1\" 200\n10.0.0.1 [18/Oct/2026:10:00:00 +0000] GET / 200\n"
+	if err := ioutil.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatalf("Failed to write log: %s", err.Error())
+	}
+
+	var out bytes.Buffer
+	code := Validate("test", []string{"-format", `$remote_addr [$time_local] "$request" $status`, path}, &out)
+	if code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+
+	for _, expected := range []string{
+		path + ":1: OK",
+		`$status = "200"`,
+		`"responseCode": "200"`,
+		path + ":2: FAIL: Match not found at byte 38, segment 1 (time_local): expected \"] \\\"\"",
+		"2 lines, 1 failed",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Output doesn't contain %q:\n%s", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	if code := Validate("test", []string{"-noreject", "-format", `$remote_addr [$time_local]`, path}, &out); code != 0 {
+		t.Errorf("Expected exit code 0, got %d:\n%s", code, out.String())
+	}
+}
@@ -0,0 +1,249 @@
+package otlp
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common/otlpmodel"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Severities of OTLP severity numbers, in ranges of four from TRACE to FATAL
+var severities = []contracts.SeverityLevel{
+	appinsights.Verbose,
+	appinsights.Verbose,
+	appinsights.Information,
+	appinsights.Warning,
+	appinsights.Error,
+	appinsights.Critical,
+}
+
+// Severities of the usual severity texts, for records without a number
+var severityTexts = map[string]contracts.SeverityLevel{
+	"trace":   appinsights.Verbose,
+	"debug":   appinsights.Verbose,
+	"info":    appinsights.Information,
+	"warn":    appinsights.Warning,
+	"warning": appinsights.Warning,
+	"error":   appinsights.Error,
+	"fatal":   appinsights.Critical,
+}
+
+// spanTelemetry converts a server or consumer span to a request, and other
+// spans to a dependency.  The span's attributes become properties.
+func spanTelemetry(s *otlpmodel.Span, r *otlpmodel.Resource) appinsights.Telemetry {
+	attributes := otlpmodel.AttributeMap(s.Attributes)
+	start := unixTime(s.StartTimeUnixNano)
+	duration := time.Duration(0)
+	if s.EndTimeUnixNano > s.StartTimeUnixNano {
+		duration = time.Duration(s.EndTimeUnixNano - s.StartTimeUnixNano)
+	}
+
+	code := first(attributes, "http.response.status_code", "http.status_code", "rpc.grpc.status_code")
+
+	var telem appinsights.Telemetry
+	var tags contracts.ContextTags
+	if s.Kind == otlpmodel.SpanKindServer || s.Kind == otlpmodel.SpanKindConsumer {
+		if code == "" {
+			code = "0"
+		}
+
+		request := appinsights.NewRequestTelemetry(first(attributes, "http.request.method", "http.method"), requestUrl(attributes), duration, code)
+		request.Id = s.SpanId
+		request.Name = s.Name
+		request.Success = succeeded(s, request.Success)
+		request.Properties = attributes
+		request.Timestamp = start
+		request.Tags.Operation().SetName(s.Name)
+		telem, tags = request, request.Tags
+	} else {
+		dependencyType, target, data := dependencyDetails(s.Kind, attributes)
+		success := true
+		if status, err := strconv.Atoi(code); err == nil && status >= 400 {
+			success = false
+		}
+
+		dependency := appinsights.NewRemoteDependencyTelemetry(s.Name, dependencyType, target, succeeded(s, success))
+		dependency.Id = s.SpanId
+		dependency.ResultCode = code
+		dependency.Data = data
+		dependency.Duration = duration
+		dependency.Properties = attributes
+		dependency.Timestamp = start
+		telem, tags = dependency, dependency.Tags
+	}
+
+	if s.Status.Message != "" {
+		attributes["otel.status_description"] = s.Status.Message
+	}
+
+	setTags(tags, attributes, r, s.TraceId, s.ParentSpanId)
+	return telem
+}
+
+// logTelemetry converts a log record to a trace.  The record's attributes
+// become properties.
+func logTelemetry(record *otlpmodel.LogRecord, r *otlpmodel.Resource) appinsights.Telemetry {
+	severity := appinsights.Information
+	if record.SeverityNumber > 0 && record.SeverityNumber <= 4*len(severities) {
+		severity = severities[(record.SeverityNumber-1)/4]
+	} else if level, ok := severityTexts[strings.ToLower(record.SeverityText)]; ok {
+		severity = level
+	}
+
+	trace := appinsights.NewTraceTelemetry(record.Body.String(), severity)
+	trace.Properties = otlpmodel.AttributeMap(record.Attributes)
+	if record.TimeUnixNano != 0 {
+		trace.Timestamp = unixTime(record.TimeUnixNano)
+	} else if record.ObservedTimeUnixNano != 0 {
+		trace.Timestamp = unixTime(record.ObservedTimeUnixNano)
+	}
+
+	setTags(trace.Tags, trace.Properties, r, record.TraceId, record.SpanId)
+	return trace
+}
+
+// setTags sets the operation, role and other context tags.  The role and
+// role instance are left for the pipeline to set if the resource doesn't
+// have them.
+func setTags(tags contracts.ContextTags, attributes map[string]string, r *otlpmodel.Resource, traceId, parentId string) {
+	if traceId != "" {
+		tags.Operation().SetId(traceId)
+	}
+
+	if parentId != "" {
+		tags.Operation().SetParentId(parentId)
+	}
+
+	resourceAttributes := otlpmodel.AttributeMap(r.Attributes)
+	if role := resourceAttributes["service.name"]; role != "" {
+		if namespace := resourceAttributes["service.namespace"]; namespace != "" {
+			role = fmt.Sprintf("[%s]/%s", namespace, role)
+		}
+
+		tags.Cloud().SetRole(role)
+	}
+
+	if instance := first(resourceAttributes, "service.instance.id", "host.name"); instance != "" {
+		tags.Cloud().SetRoleInstance(instance)
+	}
+
+	if ip := first(attributes, "client.address", "http.client_ip"); ip != "" {
+		tags.Location().SetIp(ip)
+	}
+
+	if user := attributes["enduser.id"]; user != "" {
+		tags.User().SetAuthUserId(user)
+	}
+}
+
+// succeeded returns whether the span succeeded according to its status, or
+// otherwise, fallback.
+func succeeded(s *otlpmodel.Span, fallback bool) bool {
+	switch s.Status.Code {
+	case otlpmodel.StatusOk:
+		return true
+	case otlpmodel.StatusError:
+		return false
+	}
+
+	return fallback
+}
+
+// requestUrl returns the URL of a server span, which may be given whole or
+// in parts.
+func requestUrl(attributes map[string]string) string {
+	if full := first(attributes, "url.full", "http.url"); full != "" {
+		return full
+	}
+
+	host := first(attributes, "server.address", "http.host", "net.host.name")
+	if host == "" {
+		return first(attributes, "url.path", "http.target")
+	}
+
+	if port := first(attributes, "server.port", "net.host.port"); port != "" && !strings.Contains(host, ":") {
+		host = host + ":" + port
+	}
+
+	result := &url.URL{
+		Scheme: first(attributes, "url.scheme", "http.scheme"),
+		Host:   host,
+		Path:   first(attributes, "url.path", "http.target"),
+	}
+
+	if result.Scheme == "" {
+		result.Scheme = "http"
+	}
+
+	if query := attributes["url.query"]; query != "" {
+		result.RawQuery = query
+	} else if i := strings.Index(result.Path, "?"); i >= 0 {
+		result.RawQuery = result.Path[i+1:]
+		result.Path = result.Path[:i]
+	}
+
+	return result.String()
+}
+
+// dependencyDetails returns the type, target and data of a dependency,
+// from the attributes of the kind of call it was.
+func dependencyDetails(kind int, attributes map[string]string) (string, string, string) {
+	target := first(attributes, "server.address", "net.peer.name", "peer.service")
+	if port := first(attributes, "server.port", "net.peer.port"); target != "" && port != "" {
+		target = target + ":" + port
+	}
+
+	switch {
+	case first(attributes, "http.request.method", "http.method") != "":
+		data := first(attributes, "url.full", "http.url")
+		if target == "" {
+			if u, err := url.Parse(data); err == nil {
+				target = u.Host
+			}
+		}
+
+		return "HTTP", target, data
+	case attributes["db.system"] != "":
+		if name := first(attributes, "db.namespace", "db.name"); name != "" {
+			target = strings.TrimPrefix(target+" | "+name, " | ")
+		}
+
+		return attributes["db.system"], target, first(attributes, "db.query.text", "db.statement")
+	case attributes["rpc.system"] != "":
+		return attributes["rpc.system"], target, ""
+	case attributes["messaging.system"] != "":
+		if destination := attributes["messaging.destination.name"]; destination != "" {
+			target = strings.TrimPrefix(target+"/"+destination, "/")
+		}
+
+		return attributes["messaging.system"], target, ""
+	case kind == otlpmodel.SpanKindInternal:
+		return "InProc", target, ""
+	}
+
+	return "Other", target, ""
+}
+
+// first returns the value of the first of the keys that is set.
+func first(attributes map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value := attributes[key]; value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func unixTime(nanos otlpmodel.Uint64) time.Time {
+	if nanos == 0 {
+		return time.Now()
+	}
+
+	return time.Unix(0, int64(nanos))
+}
@@ -0,0 +1,189 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common"
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common/otlpmodel"
+)
+
+// Largest request body accepted, after decompression
+const maxBodySize = 32 << 20
+
+func init() {
+	common.RegisterHandler("otlp", NewHandler)
+}
+
+// NewHandler creates a handler that receives OpenTelemetry spans and logs,
+// over OTLP/HTTP from an 'http:' input, or as lines of OTLP JSON, like the
+// OpenTelemetry Collector's file exporter writes.
+func NewHandler(flags *flag.FlagSet) common.LogHandler {
+	return &Handler{}
+}
+
+type Handler struct {
+	msgs    *log.Logger
+	tracker common.Tracker
+}
+
+func (handler *Handler) Initialize(msgs *log.Logger, tracker common.Tracker) error {
+	handler.msgs = msgs
+	handler.tracker = tracker
+	return nil
+}
+
+// Receive tracks the spans or logs in a line of OTLP JSON.
+func (handler *Handler) Receive(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	request := &otlpmodel.ExportRequest{}
+	if err := json.Unmarshal([]byte(line), request); err != nil {
+		return fmt.Errorf("Invalid OTLP JSON: %s", err.Error())
+	}
+
+	handler.track(request)
+	return nil
+}
+
+// ServeHTTP receives OTLP/HTTP export requests on /v1/traces and /v1/logs,
+// in protobuf or JSON.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var decode func([]byte) (*otlpmodel.ExportRequest, error)
+	switch r.URL.Path {
+	case "/v1/traces":
+		decode = otlpmodel.DecodeTraces
+	case "/v1/logs":
+		decode = otlpmodel.DecodeLogs
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/x-protobuf":
+	case "application/json":
+		decode = decodeJSON
+	default:
+		http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		handler.msgs.Printf("Error reading OTLP request from %s: %s", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request, err := decode(body)
+	if err != nil {
+		handler.msgs.Printf("Error decoding OTLP request from %s: %s", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	handler.track(request)
+
+	// Everything was accepted, which is an empty response
+	w.Header().Set("Content-Type", contentType)
+	if contentType == "application/json" {
+		io.WriteString(w, "{}")
+	}
+}
+
+// readBody reads the request body, decompressing it if needed.
+func readBody(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding %q", r.Header.Get("Content-Encoding"))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxBodySize {
+		return nil, fmt.Errorf("Request is larger than %d bytes", maxBodySize)
+	}
+
+	return data, nil
+}
+
+func decodeJSON(data []byte) (*otlpmodel.ExportRequest, error) {
+	request := &otlpmodel.ExportRequest{}
+	if err := json.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("Invalid OTLP JSON: %s", err.Error())
+	}
+
+	return request, nil
+}
+
+// track converts the spans and log records to telemetry.  Null elements,
+// which JSON allows in any of the lists, are skipped.
+func (handler *Handler) track(request *otlpmodel.ExportRequest) {
+	for _, rs := range request.ResourceSpans {
+		if rs == nil {
+			continue
+		}
+
+		for _, ss := range rs.ScopeSpans {
+			if ss == nil {
+				continue
+			}
+
+			for _, s := range ss.Spans {
+				if s != nil {
+					handler.tracker.Track(spanTelemetry(s, &rs.Resource))
+				}
+			}
+		}
+	}
+
+	for _, rl := range request.ResourceLogs {
+		if rl == nil {
+			continue
+		}
+
+		for _, sl := range rl.ScopeLogs {
+			if sl == nil {
+				continue
+			}
+
+			for _, record := range sl.LogRecords {
+				if record != nil {
+					handler.tracker.Track(logTelemetry(record, &rl.Resource))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common"
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common/otlpmodel"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Protobuf encoding helpers, for building requests
+
+func uvarint(value uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, value)]
+}
+
+func pbKey(number, wireType int) []byte {
+	return uvarint(uint64(number<<3 | wireType))
+}
+
+func pbVarint(number int, value uint64) []byte {
+	return append(pbKey(number, wireVarint), uvarint(value)...)
+}
+
+func pbFixed64(number int, value uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, value)
+	return append(pbKey(number, wireFixed64), buf...)
+}
+
+func pbBytes(number int, data []byte) []byte {
+	result := append(pbKey(number, wireBytes), uvarint(uint64(len(data)))...)
+	return append(result, data...)
+}
+
+func pbString(number int, value string) []byte {
+	return pbBytes(number, []byte(value))
+}
+
+func pbMessage(number int, fields ...[]byte) []byte {
+	return pbBytes(number, bytes.Join(fields, nil))
+}
+
+func pbAttribute(number int, key string, value []byte) []byte {
+	return pbMessage(number, pbString(1, key), pbBytes(2, value))
+}
+
+func newTestHandler(t *testing.T) (*Handler, *[]appinsights.Telemetry) {
+	handler := NewHandler(flag.NewFlagSet("test", flag.ContinueOnError)).(*Handler)
+	var tracked []appinsights.Telemetry
+	tracker := common.TrackerFunc(func(t appinsights.Telemetry) {
+		tracked = append(tracked, t)
+	})
+
+	if err := handler.Initialize(log.New(ioutil.Discard, "", 0), tracker); err != nil {
+		t.Fatalf("Initialize failed: %s", err.Error())
+	}
+
+	return handler, &tracked
+}
+
+func post(handler http.Handler, path, contentType string, body []byte, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestServeProtobufTraces(t *testing.T) {
+	handler, tracked := newTestHandler(t)
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	traceId := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	server := pbMessage(2,
+		pbBytes(1, traceId),
+		pbBytes(2, []byte{1, 1, 1, 1, 1, 1, 1, 1}),
+		pbBytes(4, []byte{2, 2, 2, 2, 2, 2, 2, 2}),
+		pbString(5, "GET /users/{id}"),
+		pbVarint(6, otlpmodel.SpanKindServer),
+		pbFixed64(7, uint64(start.UnixNano())),
+		pbFixed64(8, uint64(start.Add(250*time.Millisecond).UnixNano())),
+		pbAttribute(9, "http.request.method", pbString(1, "GET")),
+		pbAttribute(9, "url.full", pbString(1, "https://example.com/users/1")),
+		pbAttribute(9, "http.response.status_code", pbVarint(3, 503)),
+		pbAttribute(9, "client.address", pbString(1, "10.0.0.1")),
+		pbAttribute(9, "ratio", pbFixed64(4, math.Float64bits(0.5))),
+		pbAttribute(9, "tags", pbMessage(5, pbMessage(1, pbString(1, "a")), pbMessage(1, pbVarint(2, 1)))))
+
+	client := pbMessage(2,
+		pbBytes(1, traceId),
+		pbBytes(2, []byte{3, 3, 3, 3, 3, 3, 3, 3}),
+		pbBytes(4, []byte{1, 1, 1, 1, 1, 1, 1, 1}),
+		pbString(5, "SELECT users"),
+		pbVarint(6, otlpmodel.SpanKindClient),
+		pbFixed64(7, uint64(start.UnixNano())),
+		pbFixed64(8, uint64(start.Add(time.Millisecond).UnixNano())),
+		pbAttribute(9, "db.system", pbString(1, "postgresql")),
+		pbAttribute(9, "db.name", pbString(1, "app")),
+		pbAttribute(9, "server.address", pbString(1, "db")),
+		pbAttribute(9, "db.statement", pbString(1, "SELECT * FROM users")),
+		pbMessage(15, pbString(2, "timeout"), pbVarint(3, otlpmodel.StatusError)))
+
+	body := pbMessage(1,
+		pbMessage(1, pbAttribute(1, "service.name", pbString(1, "api")), pbAttribute(1, "service.instance.id", pbString(1, "api-1"))),
+		pbMessage(2, pbMessage(1, pbString(1, "scope")), server, client))
+
+	// Compressed, as exporters often do
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(body)
+	zw.Close()
+
+	w := post(handler, "/v1/traces", "application/x-protobuf", compressed.Bytes(), "Content-Encoding", "gzip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	if len(*tracked) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(*tracked))
+	}
+
+	request, ok := (*tracked)[0].(*appinsights.RequestTelemetry)
+	if !ok {
+		t.Fatalf("Expected request telemetry, got %T", (*tracked)[0])
+	}
+
+	if request.Name != "GET /users/{id}" || request.Url != "https://example.com/users/1" || request.ResponseCode != "503" ||
+		request.Success || request.Duration != 250*time.Millisecond || !request.Timestamp.Equal(start) || request.Id != "0101010101010101" {
+		t.Errorf("Unexpected request: %+v", request)
+	}
+
+	tags := request.Tags
+	if tags[contracts.OperationId] != "000102030405060708090a0b0c0d0e0f" || tags[contracts.OperationParentId] != "0202020202020202" ||
+		tags[contracts.CloudRole] != "api" || tags[contracts.CloudRoleInstance] != "api-1" || tags[contracts.LocationIp] != "10.0.0.1" {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+
+	if request.Properties["ratio"] != "0.5" || request.Properties["tags"] != `["a",true]` {
+		t.Errorf("Unexpected properties: %v", request.Properties)
+	}
+
+	dependency, ok := (*tracked)[1].(*appinsights.RemoteDependencyTelemetry)
+	if !ok {
+		t.Fatalf("Expected dependency telemetry, got %T", (*tracked)[1])
+	}
+
+	if dependency.Type != "postgresql" || dependency.Target != "db | app" || dependency.Data != "SELECT * FROM users" ||
+		dependency.Success || dependency.Properties["otel.status_description"] != "timeout" ||
+		dependency.Tags[contracts.OperationParentId] != "0101010101010101" {
+		t.Errorf("Unexpected dependency: %+v", dependency)
+	}
+}
+
+func TestServeJSONLogs(t *testing.T) {
+	handler, tracked := newTestHandler(t)
+	body := `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"worker"}}]},
+		"scopeLogs":[{"logRecords":[
+			{"timeUnixNano":"1792317600000000000","severityNumber":17,"body":{"stringValue":"failed"},
+			 "attributes":[{"key":"attempt","value":{"intValue":"3"}}],
+			 "traceId":"000102030405060708090a0b0c0d0e0f","spanId":"0101010101010101"},
+			{"severityText":"WARN","body":{"kvlistValue":{"values":[{"key":"a","value":{"boolValue":false}}]}}}
+		]}]}]}`
+
+	w := post(handler, "/v1/logs", "application/json; charset=utf-8", []byte(body))
+	if w.Code != http.StatusOK || w.Body.String() != "{}" {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	if len(*tracked) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(*tracked))
+	}
+
+	trace := (*tracked)[0].(*appinsights.TraceTelemetry)
+	if trace.Message != "failed" || trace.SeverityLevel != appinsights.Error || trace.Properties["attempt"] != "3" ||
+		trace.Timestamp.Unix() != 1792317600 || trace.Tags[contracts.OperationId] != "000102030405060708090a0b0c0d0e0f" ||
+		trace.Tags[contracts.OperationParentId] != "0101010101010101" || trace.Tags[contracts.CloudRole] != "worker" {
+		t.Errorf("Unexpected trace: %+v", trace)
+	}
+
+	trace = (*tracked)[1].(*appinsights.TraceTelemetry)
+	if trace.Message != `{"a":false}` || trace.SeverityLevel != appinsights.Warning {
+		t.Errorf("Unexpected trace: %+v", trace)
+	}
+}
+
+func TestServeProtobufLogs(t *testing.T) {
+	handler, tracked := newTestHandler(t)
+	body := pbMessage(1, pbMessage(2, pbMessage(2,
+		pbFixed64(11, 1792317600000000000),
+		pbVarint(2, 5),
+		pbMessage(5, pbString(1, "debugging")))))
+
+	if w := post(handler, "/v1/logs", "application/x-protobuf", body); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	if len(*tracked) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(*tracked))
+	}
+
+	trace := (*tracked)[0].(*appinsights.TraceTelemetry)
+	if trace.Message != "debugging" || trace.SeverityLevel != appinsights.Verbose || trace.Timestamp.Unix() != 1792317600 {
+		t.Errorf("Unexpected trace: %+v", trace)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	handler, tracked := newTestHandler(t)
+	var msgs bytes.Buffer
+	handler.msgs = log.New(&msgs, "", 0)
+	valid := pbMessage(1, pbMessage(2, pbMessage(2, pbString(5, "span"))))
+
+	for _, test := range []struct {
+		method, path, contentType string
+		body                      []byte
+		code                      int
+	}{
+		{http.MethodPost, "/v1/metrics", "application/x-protobuf", valid, http.StatusNotFound},
+		{http.MethodGet, "/v1/traces", "application/x-protobuf", nil, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v1/traces", "text/plain", valid, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/v1/traces", "application/x-protobuf", valid[:len(valid)-2], http.StatusBadRequest},
+		{http.MethodPost, "/v1/traces", "application/x-protobuf", pbVarint(1, 1), http.StatusBadRequest},
+		{http.MethodPost, "/v1/traces", "application/json", []byte("{"), http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(test.method, test.path, bytes.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s %s: expected %d, got %d %s", test.method, test.path, test.contentType, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	if len(*tracked) != 0 {
+		t.Errorf("Expected nothing tracked, got %d items", len(*tracked))
+	}
+
+	// Requests that were rejected for their contents go to the output
+	// messages
+	if n := strings.Count(msgs.String(), "Error decoding OTLP request from "); n != 3 {
+		t.Errorf("Expected 3 messages, got: %s", msgs.String())
+	}
+}
+
+// nestedBody returns a log record body of arrays nested depth deep.
+func nestedBody(depth int) []byte {
+	value := pbString(1, "leaf")
+	for i := 0; i < depth; i++ {
+		value = pbMessage(5, pbBytes(1, value))
+	}
+
+	return pbBytes(5, value)
+}
+
+func TestServeNestedProtobuf(t *testing.T) {
+	handler, tracked := newTestHandler(t)
+	body := pbMessage(1, pbMessage(2, pbMessage(2, nestedBody(20))))
+	if w := post(handler, "/v1/logs", "application/x-protobuf", body); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	if len(*tracked) != 1 || !strings.Contains((*tracked)[0].(*appinsights.TraceTelemetry).Message, `"leaf"`) {
+		t.Fatalf("Unexpected telemetry: %+v", *tracked)
+	}
+
+	// Deeper nesting is rejected rather than decoded recursively
+	body = pbMessage(1, pbMessage(2, pbMessage(2, nestedBody(1000))))
+	w := post(handler, "/v1/logs", "application/x-protobuf", body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "nested more than 64 deep") {
+		t.Errorf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	if len(*tracked) != 1 {
+		t.Errorf("Expected nothing more tracked, got %d items", len(*tracked))
+	}
+}
+
+func TestReceive(t *testing.T) {
+	handler, tracked := newTestHandler(t)
+	line := `{"resourceSpans":[{"scopeSpans":[{"spans":[{"name":"work","kind":1,"startTimeUnixNano":1792317600000000000,"endTimeUnixNano":"1792317601000000000"}]}]}]}` + "\n"
+	if err := handler.Receive(line); err != nil {
+		t.Fatalf("Receive failed: %s", err.Error())
+	}
+
+	if err := handler.Receive("not json"); err == nil || !strings.Contains(err.Error(), "Invalid OTLP JSON") {
+		t.Errorf("Expected an error for an invalid line, got %v", err)
+	}
+
+	if len(*tracked) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(*tracked))
+	}
+
+	dependency := (*tracked)[0].(*appinsights.RemoteDependencyTelemetry)
+	if dependency.Name != "work" || dependency.Type != "InProc" || dependency.Duration != time.Second || !dependency.Success {
+		t.Errorf("Unexpected dependency: %+v", dependency)
+	}
+}
+
+// Requests with null elements in their lists, and how many items each
+// should track
+var nullElements = map[string]int{
+	`{"resourceSpans":[null]}`: 0,
+	`{"resourceSpans":[{"scopeSpans":[null,{"spans":[null,{"name":"a"}]}]}]}`:           1,
+	`{"resourceLogs":[{"scopeLogs":[{"logRecords":[null]}]}]}`:                          0,
+	`{"resourceLogs":[null,{"resource":{"attributes":[null]},"scopeLogs":[null]}]}`:     0,
+	`{"resourceSpans":[{"scopeSpans":[{"spans":[{"name":"a","attributes":[null]}]}]}]}`: 1,
+	`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"body":{"arrayValue":{"values":[null]}}},` +
+		`{"body":{"kvlistValue":{"values":[null,{"key":"k","value":{"boolValue":true}}]}}}]}]}]}`: 2,
+}
+
+func TestReceiveNullElements(t *testing.T) {
+	for line, expected := range nullElements {
+		handler, tracked := newTestHandler(t)
+		if err := handler.Receive(line); err != nil {
+			t.Errorf("Receive failed for %s: %s", line, err.Error())
+		}
+
+		if len(*tracked) != expected {
+			t.Errorf("Expected %d items for %s, got %d", expected, line, len(*tracked))
+		}
+	}
+}
+
+func TestServeNullElements(t *testing.T) {
+	for body, expected := range nullElements {
+		handler, tracked := newTestHandler(t)
+		path := "/v1/traces"
+		if strings.Contains(body, "resourceLogs") {
+			path = "/v1/logs"
+		}
+
+		if w := post(handler, path, "application/json", []byte(body)); w.Code != http.StatusOK {
+			t.Errorf("Unexpected status %d for %s", w.Code, body)
+		}
+
+		if len(*tracked) != expected {
+			t.Errorf("Expected %d items for %s, got %d", expected, body, len(*tracked))
+		}
+	}
+}
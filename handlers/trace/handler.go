@@ -0,0 +1,170 @@
+package trace
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+	"github.com/jjjordanmsft/ApplicationInsights-logforward/common"
+)
+
+var (
+	severity = map[string]contracts.SeverityLevel{
+		"verbose":     appinsights.Verbose,
+		"information": appinsights.Information,
+		"info":        appinsights.Information,
+		"warning":     appinsights.Warning,
+		"warn":        appinsights.Warning,
+		"error":       appinsights.Error,
+		"err":         appinsights.Error,
+		"critical":    appinsights.Critical,
+		"crit":        appinsights.Critical,
+	}
+)
+
+func init() {
+	common.RegisterHandler("trace", NewHandler)
+}
+
+// NewHandler creates a handler that sends each line (or batch of lines) as a
+// trace.
+func NewHandler(flags *flag.FlagSet) common.LogHandler {
+	handler := &Handler{}
+	flags.Var(&handler.filterInclude, "include", "Include lines that match this regex")
+	flags.Var(&handler.filterExclude, "exclude", "Exclude lines that match this regex")
+	flags.IntVar(&handler.batchTime, "batch", 0, "Batch output for n seconds and send as a single trace")
+	flags.StringVar(&handler.sevstring, "severity", "Information", "Severity level in trace telemetry: Verbose, Information, Warning, Error, Critical")
+	return handler
+}
+
+// traceLine is a line on its way to be sent, and whether it is partial.
+type traceLine struct {
+	text    string
+	partial bool
+}
+
+type Handler struct {
+	msgs          *log.Logger
+	tracker       common.Tracker
+	filterInclude common.RegexpList
+	filterExclude common.RegexpList
+	batchTime     int
+	channel       chan traceLine
+	finished      chan struct{}
+	sevstring     string
+	severity      contracts.SeverityLevel
+}
+
+func (handler *Handler) Initialize(msgs *log.Logger, tracker common.Tracker) error {
+	handler.msgs = msgs
+	handler.tracker = tracker
+
+	if val, ok := severity[strings.ToLower(handler.sevstring)]; ok {
+		handler.severity = val
+	} else {
+		return fmt.Errorf("Invalid severity level, must be one of: verbose, information, warning, error, critical")
+	}
+
+	handler.channel = make(chan traceLine)
+	handler.finished = make(chan struct{})
+	if handler.batchTime > 0 {
+		go handler.batchMessages()
+	} else {
+		go handler.passMessages()
+	}
+
+	return nil
+}
+
+func (handler *Handler) Receive(line string) error {
+	return handler.receive(line, false)
+}
+
+// ReceivePartial is like Receive, but marks the trace (or its batch) as
+// containing a partial line.
+func (handler *Handler) ReceivePartial(line string) error {
+	return handler.receive(line, true)
+}
+
+func (handler *Handler) receive(line string, partial bool) error {
+	tst := strings.TrimRight(line, "\r\n")
+
+	if handler.filterInclude.MatchAny(tst, true) && !handler.filterExclude.MatchAny(tst, false) {
+		handler.channel <- traceLine{line, partial}
+	} else {
+		log.Printf("Line didn't pass regexps: %s", line)
+	}
+
+	return nil
+}
+
+// Close sends any pending batch and stops the handler.
+func (handler *Handler) Close() error {
+	close(handler.channel)
+	<-handler.finished
+	return nil
+}
+
+func (handler *Handler) batchMessages() {
+	defer close(handler.finished)
+
+	var buf bytes.Buffer
+	partial := false
+
+	for {
+		line, ok := <-handler.channel
+		if !ok {
+			return
+		}
+
+		buf.WriteString(line.text)
+		partial = line.partial
+
+		timeout := time.After(time.Duration(handler.batchTime) * time.Second)
+	wait:
+		for {
+			select {
+			case line, ok = <-handler.channel:
+				if ok {
+					buf.WriteString(line.text)
+					partial = partial || line.partial
+					break
+				}
+
+				handler.sendBatch(&buf, partial)
+				return
+			case _ = <-timeout:
+				handler.sendBatch(&buf, partial)
+				break wait
+			}
+		}
+	}
+}
+
+func (handler *Handler) sendBatch(buf *bytes.Buffer, partial bool) {
+	t := appinsights.NewTraceTelemetry(buf.String(), handler.severity)
+	if partial {
+		t.Properties[common.PartialLineProperty] = "true"
+	}
+
+	handler.tracker.Track(t)
+	buf.Reset()
+}
+
+func (handler *Handler) passMessages() {
+	defer close(handler.finished)
+
+	for line := range handler.channel {
+		t := appinsights.NewTraceTelemetry(strings.TrimRight(line.text, "\r\n"), handler.severity)
+		if line.partial {
+			t.Properties[common.PartialLineProperty] = "true"
+		}
+
+		handler.tracker.Track(t)
+	}
+}
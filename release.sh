@@ -2,18 +2,24 @@
 
 # Clean + build
 cd $(dirname $0)
-rm -rf ailogtrace/ailogtrace ailognginx/ailognginx ailognginx-* ailogtrace-*
+LDFLAGS="-X github.com/jjjordanmsft/ApplicationInsights-logforward/common.Version=$1"
+rm -rf ailogtrace/ailogtrace ailognginx/ailognginx ailogforward/ailogforward ailognginx-* ailogtrace-* ailogforward-*
 cd ailogtrace
-go build || exit $?
+go build -ldflags "$LDFLAGS" || exit $?
 cd ../ailognginx
-go build || exit $?
+go build -ldflags "$LDFLAGS" || exit $?
+cd ../ailogforward
+go build -ldflags "$LDFLAGS" || exit $?
 cd ..
 
 mv ailognginx/ailognginx ./ailognginx-$1
 mv ailogtrace/ailogtrace ./ailogtrace-$1
+mv ailogforward/ailogforward ./ailogforward-$1
 
 gpg --armor --detach-sig ailognginx-$1 || exit $1
 gpg --armor --detach-sig ailogtrace-$1 || exit $1
+gpg --armor --detach-sig ailogforward-$1 || exit $1
 
 gpg --verify ailogtrace-$1.asc ailogtrace-$1
 gpg --verify ailognginx-$1.asc ailognginx-$1
+gpg --verify ailogforward-$1.asc ailogforward-$1